@@ -0,0 +1,78 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer picks the endpoint of each call among the available ones.
+// pools is never empty. Implementations must be safe for concurrent use.
+type Balancer interface {
+	Pick(pools []*ThriftConnPool) *ThriftConnPool
+}
+
+type roundRobinBalancer struct {
+	next uint32 // atomic
+}
+
+// NewRoundRobinBalancer returns a Balancer cycling through the endpoints.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(pools []*ThriftConnPool) *ThriftConnPool {
+	n := atomic.AddUint32(&b.next, 1)
+	return pools[int(n%uint32(len(pools)))]
+}
+
+type leastInFlightBalancer struct {
+	intn func(n int) int // 随机数源，测试时替换
+}
+
+// NewLeastInFlightBalancer returns a Balancer picking the endpoint with
+// the fewest calls in flight, including the ones waiting for a connection.
+func NewLeastInFlightBalancer() Balancer {
+	return leastInFlightBalancer{intn: rand.Intn}
+}
+
+func (b leastInFlightBalancer) Pick(pools []*ThriftConnPool) *ThriftConnPool {
+	// 从随机位置开始遍历，避免负载相同时总是选中第一个
+	start := b.intn(len(pools))
+	best := pools[start]
+	bestN := best.InFlight()
+	for i := 1; i < len(pools); i++ {
+		p := pools[(start+i)%len(pools)]
+		if n := p.InFlight(); n < bestN {
+			best, bestN = p, n
+		}
+	}
+	return best
+}
+
+type p2cBalancer struct {
+	intn func(n int) int // 随机数源，测试时替换
+}
+
+// NewP2CBalancer returns a Balancer using the power of two choices: it
+// samples two endpoints at random and picks the one with fewer calls in
+// flight.
+func NewP2CBalancer() Balancer {
+	return p2cBalancer{intn: rand.Intn}
+}
+
+func (b p2cBalancer) Pick(pools []*ThriftConnPool) *ThriftConnPool {
+	if len(pools) == 1 {
+		return pools[0]
+	}
+	i := b.intn(len(pools))
+	j := b.intn(len(pools) - 1)
+	if j >= i {
+		j++
+	}
+	if pools[j].InFlight() < pools[i].InFlight() {
+		return pools[j]
+	}
+	return pools[i]
+}
@@ -0,0 +1,154 @@
+package gohbase
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// newBalancerPools returns pools with the given numbers of calls in flight.
+func newBalancerPools(t *testing.T, inFlight ...int) []*ThriftConnPool {
+	pools := make([]*ThriftConnPool, len(inFlight))
+	for i, n := range inFlight {
+		opt := &Options{Addr: "thrift" + string(rune('1'+i)) + ":9090", PoolSize: 10}
+		opt.init()
+		pool := NewThriftConnPool(opt)
+		t.Cleanup(func() { _ = pool.Close() })
+		for j := 0; j < n; j++ {
+			if err := pool.waitTurn(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pools[i] = pool
+	}
+	return pools
+}
+
+// index returns the index of pool in pools.
+func index(pools []*ThriftConnPool, pool *ThriftConnPool) int {
+	for i, p := range pools {
+		if p == pool {
+			return i
+		}
+	}
+	return -1
+}
+
+// scripted returns an intn answering the given values in turn.
+func scripted(t *testing.T, values ...int) func(n int) int {
+	return func(n int) int {
+		if len(values) == 0 {
+			t.Fatal("no scripted random value left")
+		}
+		v := values[0]
+		values = values[1:]
+		if v >= n {
+			t.Fatalf("scripted random value %d out of [0, %d)", v, n)
+		}
+		return v
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	pools := newBalancerPools(t, 0, 5, 0)
+	b := NewRoundRobinBalancer()
+	var got []int
+	for i := 0; i < 6; i++ {
+		got = append(got, index(pools, b.Pick(pools)))
+	}
+	want := []int{1, 2, 0, 1, 2, 0}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round robin picked %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	for _, tc := range []struct {
+		inFlight []int
+		start    int
+		want     int
+	}{
+		{[]int{2, 0, 1}, 0, 1},
+		{[]int{2, 0, 1}, 2, 1},
+		{[]int{1, 1, 1}, 0, 0},
+		{[]int{1, 1, 1}, 2, 2},
+		{[]int{3, 1, 1}, 2, 2}, // 相同负载时取遍历到的第一个
+		{[]int{3, 1, 1}, 0, 1},
+	} {
+		pools := newBalancerPools(t, tc.inFlight...)
+		b := leastInFlightBalancer{intn: scripted(t, tc.start)}
+		if got := index(pools, b.Pick(pools)); got != tc.want {
+			t.Errorf("least in flight of %v from %d picked %d, want %d", tc.inFlight, tc.start, got, tc.want)
+		}
+	}
+}
+
+func TestP2CBalancer(t *testing.T) {
+	for _, tc := range []struct {
+		inFlight []int
+		i, j     int // 随机数，j 不小于 i 时加一以跳过 i
+		want     int
+	}{
+		{[]int{0, 5, 5}, 1, 1, 1}, // 抽中 1 和 2，负载相同时取第一个
+		{[]int{0, 5, 5}, 1, 0, 0},
+		{[]int{0, 5, 5}, 0, 0, 0},
+		{[]int{4, 1, 2}, 0, 1, 2},
+		{[]int{4, 1, 2}, 2, 0, 2},
+		{[]int{4, 1, 2}, 2, 1, 1},
+	} {
+		pools := newBalancerPools(t, tc.inFlight...)
+		b := p2cBalancer{intn: scripted(t, tc.i, tc.j)}
+		if got := index(pools, b.Pick(pools)); got != tc.want {
+			t.Errorf("p2c of %v sampling %d, %d picked %d, want %d", tc.inFlight, tc.i, tc.j, got, tc.want)
+		}
+	}
+
+	// 负载最小的端点在被抽中时总是胜出，约占三分之二
+	pools := newBalancerPools(t, 0, 5, 5)
+	b := p2cBalancer{intn: rand.New(rand.NewSource(1)).Intn}
+	counts := make([]int, len(pools))
+	for i := 0; i < 3000; i++ {
+		counts[index(pools, b.Pick(pools))]++
+	}
+	if counts[0] < 1800 || counts[0] > 2200 {
+		t.Errorf("p2c picked the idle endpoint %d times out of 3000, want about 2000", counts[0])
+	}
+
+	single := newBalancerPools(t, 1)
+	if b.Pick(single) != single[0] {
+		t.Error("p2c did not pick the single endpoint")
+	}
+}
+
+func TestEndpointStats(t *testing.T) {
+	addrs := []string{newTestServer(t, &fakeHandler{}), newTestServer(t, &fakeHandler{})}
+	hb := NewHBase(&Options{Addrs: addrs, Balancer: NewRoundRobinBalancer()})
+	defer hb.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := hb.EndpointStats()
+	if len(stats) != len(addrs) {
+		t.Fatalf("EndpointStats has %d endpoints, want %d", len(stats), len(addrs))
+	}
+	for _, addr := range addrs {
+		s := stats[addr]
+		if s == nil {
+			t.Fatalf("EndpointStats lacks %s", addr)
+		}
+		if s.Hits != 1 || s.Misses != 1 || s.TotalConns != 1 || s.IdleConns != 1 {
+			t.Errorf("%s has hits %d, misses %d, %d conns, %d idle, want 1 each", addr, s.Hits, s.Misses, s.TotalConns, s.IdleConns)
+		}
+	}
+	if s := hb.PoolStats(); s.Hits != 2 || s.Misses != 2 || s.TotalConns != 2 {
+		t.Errorf("PoolStats has hits %d, misses %d, %d conns, want 2 each", s.Hits, s.Misses, s.TotalConns)
+	}
+}
@@ -0,0 +1,182 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of an endpoint.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls fast with ErrBreakerOpen.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to decide whether
+	// to close the breaker again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker trips after Options.BreakerFailures consecutive failures,
+// or when the error rate over Options.BreakerWindow reaches
+// Options.BreakerErrorRate. A nil *circuitBreaker is disabled and lets
+// every call through.
+type circuitBreaker struct {
+	opt *Options
+	now func() time.Time // 时钟，测试时替换
+
+	mu          sync.Mutex
+	state       BreakerState
+	openedAt    time.Time
+	probing     bool // 半开状态下已放行一个探测请求
+	consecutive int  // 连续失败次数
+	windowStart time.Time
+	requests    int
+	failures    int
+	trips       uint32
+}
+
+func newCircuitBreaker(opt *Options) *circuitBreaker {
+	if opt.BreakerFailures <= 0 && opt.BreakerErrorRate <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		opt:         opt,
+		now:         time.Now,
+		windowStart: time.Now(),
+	}
+}
+
+// allow reports whether a call may proceed. Every allowed call must be
+// followed by done, or by cancel if it never reached the server.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.opt.BreakerOpenTimeout {
+			return &Error{Kind: ErrBreakerOpen, Msg: cb.opt.Addr}
+		}
+		cb.state = BreakerHalfOpen
+		cb.probing = false
+		fallthrough
+	case BreakerHalfOpen:
+		if cb.probing {
+			return &Error{Kind: ErrBreakerOpen, Msg: cb.opt.Addr}
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// cancel undoes allow for a call that was given up before it was sent.
+func (cb *circuitBreaker) cancel() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+	}
+	cb.mu.Unlock()
+}
+
+// done records the outcome of an allowed call.
+func (cb *circuitBreaker) done(failed bool) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerHalfOpen {
+		if failed {
+			cb.trip()
+		} else {
+			cb.reset()
+		}
+		return
+	}
+	if cb.state == BreakerOpen {
+		return
+	}
+
+	now := cb.now()
+	if now.Sub(cb.windowStart) >= cb.opt.BreakerWindow {
+		cb.windowStart = now
+		cb.requests = 0
+		cb.failures = 0
+	}
+	cb.requests++
+	if !failed {
+		cb.consecutive = 0
+		return
+	}
+	cb.failures++
+	cb.consecutive++
+
+	if cb.opt.BreakerFailures > 0 && cb.consecutive >= cb.opt.BreakerFailures {
+		cb.trip()
+		return
+	}
+	if cb.opt.BreakerErrorRate > 0 && cb.requests >= cb.opt.BreakerMinRequests &&
+		float64(cb.failures)/float64(cb.requests) >= cb.opt.BreakerErrorRate {
+		cb.trip()
+	}
+}
+
+// trip must be called with cb.mu held.
+func (cb *circuitBreaker) trip() {
+	cb.state = BreakerOpen
+	cb.openedAt = cb.now()
+	cb.probing = false
+	cb.trips++
+}
+
+// reset must be called with cb.mu held.
+func (cb *circuitBreaker) reset() {
+	cb.state = BreakerClosed
+	cb.probing = false
+	cb.consecutive = 0
+	cb.windowStart = cb.now()
+	cb.requests = 0
+	cb.failures = 0
+}
+
+// stats returns the current state and the number of times it tripped.
+func (cb *circuitBreaker) stats() (BreakerState, uint32) {
+	if cb == nil {
+		return BreakerClosed, 0
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	state := cb.state
+	if state == BreakerOpen && cb.now().Sub(cb.openedAt) >= cb.opt.BreakerOpenTimeout {
+		state = BreakerHalfOpen
+	}
+	return state, cb.trips
+}
@@ -0,0 +1,163 @@
+package gohbase
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock advanced by hand.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestBreaker returns the breaker of opt running on a fake clock.
+func newTestBreaker(t *testing.T, opt *Options) (*circuitBreaker, *fakeClock) {
+	opt.Addr = "thrift1:9090"
+	opt.init()
+	cb := newCircuitBreaker(opt)
+	if cb == nil {
+		t.Fatal("breaker is disabled")
+	}
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	cb.now = clock.now
+	cb.windowStart = clock.now()
+	return cb, clock
+}
+
+// call runs a call through cb, failed or not. It reports false if cb
+// turned the call away.
+func call(t *testing.T, cb *circuitBreaker, failed bool) bool {
+	t.Helper()
+	if err := cb.allow(); err != nil {
+		if !errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("allow = %v, want %v", err, ErrBreakerOpen)
+		}
+		return false
+	}
+	cb.done(failed)
+	return true
+}
+
+func expectBreaker(t *testing.T, cb *circuitBreaker, state BreakerState, trips uint32) {
+	t.Helper()
+	if s, n := cb.stats(); s != state || n != trips {
+		t.Fatalf("breaker is %s after %d trips, want %s after %d", s, n, state, trips)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	opt := &Options{}
+	opt.init()
+	cb := newCircuitBreaker(opt)
+	if cb != nil {
+		t.Fatal("breaker is enabled without BreakerFailures or BreakerErrorRate")
+	}
+	for i := 0; i < 10; i++ {
+		if err := cb.allow(); err != nil {
+			t.Fatal(err)
+		}
+		cb.done(true)
+	}
+	expectBreaker(t, cb, BreakerClosed, 0)
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	cb, clock := newTestBreaker(t, &Options{BreakerFailures: 3, BreakerOpenTimeout: time.Second})
+
+	// 成功的调用清零连续失败次数
+	call(t, cb, true)
+	call(t, cb, true)
+	call(t, cb, false)
+	call(t, cb, true)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerClosed, 0)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerOpen, 1)
+	if call(t, cb, false) {
+		t.Fatal("open breaker let a call through")
+	}
+
+	clock.advance(time.Second - time.Nanosecond)
+	expectBreaker(t, cb, BreakerOpen, 1)
+	clock.advance(time.Nanosecond)
+	expectBreaker(t, cb, BreakerHalfOpen, 1)
+
+	// 半开状态只放行一个探测请求，探测失败后重新打开
+	if err := cb.allow(); err != nil {
+		t.Fatalf("half-open breaker turned the probe away: %v", err)
+	}
+	if call(t, cb, false) {
+		t.Fatal("half-open breaker let a second call through during the probe")
+	}
+	cb.done(true)
+	expectBreaker(t, cb, BreakerOpen, 2)
+	if call(t, cb, false) {
+		t.Fatal("breaker reopened by a failed probe let a call through")
+	}
+
+	// 探测成功后关闭
+	clock.advance(time.Second)
+	if !call(t, cb, false) {
+		t.Fatal("half-open breaker turned the probe away")
+	}
+	expectBreaker(t, cb, BreakerClosed, 2)
+	call(t, cb, true)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerClosed, 2)
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	cb, clock := newTestBreaker(t, &Options{
+		BreakerErrorRate:   0.5,
+		BreakerMinRequests: 4,
+		BreakerWindow:      10 * time.Second,
+	})
+
+	// 调用次数不足 BreakerMinRequests 时不按错误率打开
+	call(t, cb, true)
+	call(t, cb, true)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerClosed, 0)
+
+	// 新窗口重新计数
+	clock.advance(10 * time.Second)
+	call(t, cb, false)
+	call(t, cb, false)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerClosed, 0)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerOpen, 1)
+}
+
+func TestBreakerCancel(t *testing.T) {
+	cb, clock := newTestBreaker(t, &Options{BreakerFailures: 2, BreakerOpenTimeout: time.Second})
+
+	// 未发出的调用不计入失败
+	for i := 0; i < 5; i++ {
+		if err := cb.allow(); err != nil {
+			t.Fatal(err)
+		}
+		cb.cancel()
+	}
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerClosed, 0)
+	call(t, cb, true)
+	expectBreaker(t, cb, BreakerOpen, 1)
+
+	// 取消的探测请求让出探测名额，断路器保持半开
+	clock.advance(time.Second)
+	if err := cb.allow(); err != nil {
+		t.Fatal(err)
+	}
+	cb.cancel()
+	expectBreaker(t, cb, BreakerHalfOpen, 1)
+	if !call(t, cb, false) {
+		t.Fatal("half-open breaker turned a probe away after the last one was cancelled")
+	}
+	expectBreaker(t, cb, BreakerClosed, 1)
+}
@@ -0,0 +1,426 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ejectMinSamples is the number of calls an endpoint must have served
+// before its average latency may eject it.
+const ejectMinSamples = 10
+
+// drainTimeout bounds the wait for the calls and scanners of a removed
+// endpoint, as the default scanner lease of HBase does.
+const drainTimeout = time.Minute
+
+// endpoint is a thrift server with its pool and outlier detection state.
+type endpoint struct {
+	pool   *ThriftConnPool
+	backup bool
+	zone   string
+
+	mu           sync.Mutex
+	consecutive  int           // 连续失败次数
+	latency      time.Duration // 调用耗时的指数加权平均
+	samples      int
+	ejectedUntil time.Time // 零值表示未被剔除
+	probing      bool
+	ejections    uint32
+}
+
+// ejected reports whether the endpoint is out of rotation, and whether the
+// caller should start probing it because its cool-down is over.
+func (ep *endpoint) ejected(now time.Time) (ejected, probe bool) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.ejectedUntil.IsZero() {
+		return false, false
+	}
+	if now.Before(ep.ejectedUntil) || ep.probing {
+		return true, false
+	}
+	ep.probing = true
+	return true, true
+}
+
+// inRotation reports whether the endpoint is not ejected.
+func (ep *endpoint) inRotation() bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.ejectedUntil.IsZero()
+}
+
+// eject must be called with ep.mu held.
+func (ep *endpoint) eject(d time.Duration) {
+	ep.ejectedUntil = time.Now().Add(d)
+	ep.ejections++
+}
+
+// readmit must be called with ep.mu held.
+func (ep *endpoint) readmit() {
+	ep.ejectedUntil = time.Time{}
+	ep.consecutive = 0
+	ep.latency = 0
+	ep.samples = 0
+}
+
+// cluster holds one connection pool per thrift server endpoint. Calls go to
+// the primary endpoints, Addrs or those of the Resolver, and fail over to
+// BackupAddrs while no primary is available. Endpoints failing in a row or
+// answering too slowly are ejected for EjectDuration, then probed before
+// being readmitted.
+type cluster struct {
+	opt      *Options
+	balancer Balancer
+
+	mu        sync.RWMutex
+	primaries []*endpoint
+	backups   []*endpoint
+	endpoints map[*ThriftConnPool]*endpoint
+	closed    bool
+
+	ctx    context.Context // Close 时取消，中断进行中的探测
+	cancel context.CancelFunc
+	probes sync.WaitGroup
+}
+
+func newCluster(opt *Options) *cluster {
+	c := &cluster{
+		opt:       opt,
+		endpoints: make(map[*ThriftConnPool]*endpoint, len(opt.Addrs)+len(opt.BackupAddrs)),
+		balancer:  opt.Balancer,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	addrs := opt.Addrs
+	if opt.Resolver != nil {
+		if resolved, err := opt.Resolver.Resolve(); err == nil && len(resolved) > 0 {
+			addrs = resolved
+		}
+	}
+	for _, addr := range normalizeAddrs(addrs) {
+		c.primaries = append(c.primaries, c.newEndpoint(addr, false))
+	}
+	for _, addr := range opt.BackupAddrs {
+		c.backups = append(c.backups, c.newEndpoint(addr, true))
+	}
+
+	if opt.Resolver != nil {
+		opt.Resolver.Watch(c.update)
+	}
+	return c
+}
+
+// update replaces the primary endpoints by addrs. Endpoints kept keep their
+// pool; removed ones are drained.
+func (c *cluster) update(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	primaries := make([]*endpoint, 0, len(addrs))
+	var removed []*endpoint
+	for _, ep := range c.primaries {
+		if keep[ep.pool.Addr()] {
+			primaries = append(primaries, ep)
+			delete(keep, ep.pool.Addr())
+		} else {
+			removed = append(removed, ep)
+			delete(c.endpoints, ep.pool)
+		}
+	}
+	for _, addr := range normalizeAddrs(addrs) {
+		if keep[addr] {
+			primaries = append(primaries, c.newEndpoint(addr, false))
+		}
+	}
+	c.primaries = primaries
+	c.mu.Unlock()
+
+	for _, ep := range removed {
+		go drain(ep.pool, drainTimeout)
+	}
+}
+
+// drain closes pool once the calls it serves are over and its scanners
+// are closed, or timeout passed. Calls still running then fail as their
+// connection is closed. The pool is out of the cluster already: calls that
+// picked it before and borrow from it once closed are routed again, see
+// hBaseCMD.getConn.
+func drain(pool *ThriftConnPool, timeout time.Duration) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for (pool.InFlight() > 0 || pool.hasPinned()) && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	_ = pool.Close()
+}
+
+func (c *cluster) newEndpoint(addr string, backup bool) *endpoint {
+	ep := &endpoint{
+		pool:   NewThriftConnPool(c.opt.forAddr(addr)),
+		backup: backup,
+		zone:   c.opt.Zones[addr],
+	}
+	c.endpoints[ep.pool] = ep
+	return ep
+}
+
+func (c *cluster) all() []*endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append(append(make([]*endpoint, 0, len(c.primaries)+len(c.backups)), c.primaries...), c.backups...)
+}
+
+// candidates returns the pools of the endpoints in rotation and available.
+// If Options.Zone is set, only those of its zone are returned, unless all
+// of them are unavailable or saturated. It must be called with c.mu held.
+func (c *cluster) candidates(eps []*endpoint, now time.Time) []*ThriftConnPool {
+	pools := make([]*ThriftConnPool, 0, len(eps))
+	local := 0
+	for _, ep := range eps {
+		ejected, probe := ep.ejected(now)
+		if probe && !c.closed {
+			c.probes.Add(1)
+			go c.probe(ep)
+		}
+		if ejected || !ep.pool.available() {
+			continue
+		}
+		if c.opt.Zone != "" && ep.zone == c.opt.Zone && !c.saturated(ep.pool) {
+			// 本地可用的排在前面
+			pools = append(pools, nil)
+			copy(pools[local+1:], pools[local:])
+			pools[local] = ep.pool
+			local++
+			continue
+		}
+		pools = append(pools, ep.pool)
+	}
+	if local > 0 {
+		return pools[:local]
+	}
+	return pools
+}
+
+// saturated reports whether callers of pool wait longer than ZoneSpillWait
+// for a connection, on average.
+func (c *cluster) saturated(pool *ThriftConnPool) bool {
+	return c.opt.ZoneSpillWait > 0 && pool.waitAvg.value() > c.opt.ZoneSpillWait
+}
+
+// pick returns the pool serving the next call: a primary endpoint if one is
+// available, else a backup one. If no endpoint is available at all, it
+// picks among the primaries so that the call fails with their error.
+func (c *cluster) pick() *ThriftConnPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.primaries) == 1 && len(c.backups) == 0 {
+		return c.primaries[0].pool
+	}
+
+	now := time.Now()
+	pools := c.candidates(c.primaries, now)
+	if len(pools) == 0 {
+		pools = c.candidates(c.backups, now)
+	}
+	if len(pools) == 0 {
+		pools = make([]*ThriftConnPool, 0, len(c.primaries))
+		for _, ep := range c.primaries {
+			pools = append(pools, ep.pool)
+		}
+	}
+	return c.balancer.Pick(pools)
+}
+
+// poolFor returns the pool of the endpoint at addr, or nil if there is no
+// such endpoint or it is not available.
+func (c *cluster) poolFor(addr string) *ThriftConnPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, eps := range [][]*endpoint{c.primaries, c.backups} {
+		for _, ep := range eps {
+			if ep.pool.Addr() != addr {
+				continue
+			}
+			if !ep.inRotation() || !ep.pool.available() {
+				return nil
+			}
+			return ep.pool
+		}
+	}
+	return nil
+}
+
+// observe records the outcome of a call made on pool, for outlier
+// detection. Errors not caused by the endpoint are ignored.
+func (c *cluster) observe(pool *ThriftConnPool, err error, latency time.Duration) {
+	c.mu.RLock()
+	ep := c.endpoints[pool]
+	c.mu.RUnlock()
+	if ep == nil {
+		return
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if !ep.ejectedUntil.IsZero() {
+		return
+	}
+	if errors.Is(err, ErrConnBroken) {
+		ep.consecutive++
+		if c.opt.EjectConsecutiveErrors > 0 && ep.consecutive >= c.opt.EjectConsecutiveErrors {
+			ep.eject(c.opt.EjectDuration)
+		}
+		return
+	}
+	if err != nil && !isServerError(err) {
+		return
+	}
+
+	ep.consecutive = 0
+	if ep.samples == 0 {
+		ep.latency = latency
+	} else {
+		ep.latency += (latency - ep.latency) / 5
+	}
+	ep.samples++
+	if c.opt.EjectLatency > 0 && ep.samples >= ejectMinSamples && ep.latency > c.opt.EjectLatency {
+		ep.eject(c.opt.EjectDuration)
+	}
+}
+
+// probe dials the ejected endpoint and validates the connection. The
+// endpoint is readmitted on success, and ejected again otherwise. Closing
+// the cluster aborts the dial.
+func (c *cluster) probe(ep *endpoint) {
+	defer c.probes.Done()
+	err := ep.pool.probe(c.ctx)
+
+	ep.mu.Lock()
+	if err != nil {
+		ep.eject(c.opt.EjectDuration)
+	} else {
+		ep.readmit()
+	}
+	ep.probing = false
+	ep.mu.Unlock()
+}
+
+// Stats returns the stats of all endpoints added up. Its BreakerState is
+// open if the breakers of all endpoints are, half-open if some are open or
+// half-open, and closed otherwise.
+func (c *cluster) Stats() *Stats {
+	stats := &Stats{}
+	eps := c.all()
+	open, halfOpen := 0, 0
+	for _, ep := range eps {
+		s := c.endpointStats(ep)
+		stats.add(s)
+		switch s.BreakerState {
+		case BreakerOpen:
+			open++
+		case BreakerHalfOpen:
+			halfOpen++
+		}
+	}
+	switch {
+	case open > 0 && open == len(eps):
+		stats.BreakerState = BreakerOpen
+	case open > 0 || halfOpen > 0:
+		stats.BreakerState = BreakerHalfOpen
+	}
+	return stats
+}
+
+// EndpointStats returns the stats of each endpoint, by address.
+func (c *cluster) EndpointStats() map[string]*Stats {
+	eps := c.all()
+	m := make(map[string]*Stats, len(eps))
+	for _, ep := range eps {
+		m[ep.pool.Addr()] = c.endpointStats(ep)
+	}
+	return m
+}
+
+func (c *cluster) endpointStats(ep *endpoint) *Stats {
+	s := ep.pool.Stats()
+	ep.mu.Lock()
+	s.Ejected = !ep.ejectedUntil.IsZero()
+	s.Ejections = ep.ejections
+	ep.mu.Unlock()
+	return s
+}
+
+// State returns StateHealthy if all primary endpoints are healthy,
+// StateDown if all endpoints are down, and StateDegraded otherwise.
+func (c *cluster) State() PoolState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	healthy, down := 0, 0
+	for _, ep := range c.primaries {
+		switch ep.pool.State() {
+		case StateHealthy:
+			healthy++
+		case StateDown:
+			down++
+		}
+	}
+	if healthy == len(c.primaries) {
+		return StateHealthy
+	}
+	for _, ep := range c.backups {
+		if ep.pool.State() == StateDown {
+			down++
+		}
+	}
+	if down == len(c.primaries)+len(c.backups) {
+		return StateDown
+	}
+	return StateDegraded
+}
+
+func (c *cluster) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+func (c *cluster) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.cancel()
+	c.probes.Wait()
+
+	var firstErr error
+	if c.opt.Resolver != nil {
+		firstErr = c.opt.Resolver.Close()
+	}
+	for _, ep := range c.all() {
+		if err := ep.pool.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,155 @@
+package gohbase
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestClusterCloseStopsProbes(t *testing.T) {
+	dialing := make(chan struct{}, 1)
+	opt := &Options{
+		Addrs: []string{"thrift1:9090", "thrift2:9090"},
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		DialTimeout: time.Hour,
+	}
+	opt.init()
+	c := newCluster(opt)
+
+	// 剔除期已过，下一次 pick 开始探测
+	ep := c.primaries[0]
+	ep.mu.Lock()
+	ep.eject(-time.Second)
+	ep.mu.Unlock()
+	c.pick()
+	<-dialing
+
+	done := make(chan struct{})
+	go func() {
+		_ = c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not abort the probe")
+	}
+}
+
+func TestClusterBreakerState(t *testing.T) {
+	opt := &Options{
+		Addrs:              []string{"thrift1:9090", "thrift2:9090"},
+		BreakerFailures:    1,
+		BreakerOpenTimeout: time.Hour,
+	}
+	opt.init()
+	c := newCluster(opt)
+	defer c.Close()
+
+	// setState puts the breaker of endpoint i in state.
+	setState := func(i int, state BreakerState) {
+		cb := c.primaries[i].pool.breaker
+		cb.mu.Lock()
+		cb.trip()
+		cb.state = state
+		cb.mu.Unlock()
+	}
+	for _, tc := range []struct {
+		states []BreakerState
+		want   BreakerState
+	}{
+		{[]BreakerState{BreakerClosed, BreakerClosed}, BreakerClosed},
+		{[]BreakerState{BreakerHalfOpen, BreakerClosed}, BreakerHalfOpen},
+		{[]BreakerState{BreakerOpen, BreakerClosed}, BreakerHalfOpen},
+		{[]BreakerState{BreakerOpen, BreakerHalfOpen}, BreakerHalfOpen},
+		{[]BreakerState{BreakerOpen, BreakerOpen}, BreakerOpen},
+	} {
+		for i, state := range tc.states {
+			setState(i, state)
+		}
+		if s := c.Stats().BreakerState; s != tc.want {
+			t.Errorf("breakers %v add up to %s, want %s", tc.states, s, tc.want)
+		}
+	}
+}
+
+// manualResolver is a Resolver whose updates are sent by the test.
+type manualResolver struct {
+	addrs  []string
+	update func(addrs []string)
+}
+
+func (r *manualResolver) Resolve() ([]string, error) { return r.addrs, nil }
+
+func (r *manualResolver) Watch(update func(addrs []string)) { r.update = update }
+
+func (r *manualResolver) Close() error { return nil }
+
+func TestClusterUpdateDrains(t *testing.T) {
+	slow := newTestServer(t, &slowHandler{delay: 300 * time.Millisecond})
+	fast := newTestServer(t, &fakeHandler{})
+	r := &manualResolver{addrs: []string{slow}}
+	hb := NewHBase(&Options{Resolver: r})
+	defer hb.Close()
+	c := hb.(*hBaseCMD).cluster
+	removed := c.primaries[0].pool
+
+	// 慢请求进行中时移除其端点
+	done := make(chan error, 1)
+	go func() {
+		_, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")})
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for removed.InFlight() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	r.update([]string{fast})
+
+	if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")}); err != nil {
+		t.Fatal(err)
+	}
+	if s := hb.EndpointStats(); len(s) != 1 || s[fast] == nil {
+		t.Errorf("endpoints after update are %v, want only %s", s, fast)
+	}
+	if removed.closed() {
+		t.Fatal("removed pool was closed with a call in flight")
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("call in flight on the removed endpoint = %v", err)
+	}
+	deadline = time.Now().Add(time.Second)
+	for !removed.closed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !removed.closed() {
+		t.Error("removed pool was not closed once its call was over")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	opt := &Options{Addr: "thrift1:9090"}
+	opt.init()
+	pool := NewThriftConnPool(opt)
+	// 一直不结束的调用
+	if err := pool.waitTurn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	drain(pool, 50*time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("drain returned after %s", d)
+	}
+	if !pool.closed() {
+		t.Error("drain did not close the pool")
+	}
+}
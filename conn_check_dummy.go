@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !solaris && !illumos
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!solaris,!illumos
+
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import "net"
+
+func connCheck(conn net.Conn) error {
+	return nil
+}
@@ -2,6 +2,9 @@
 package gohbase
 
 import (
+	"context"
+	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,11 +16,19 @@ import (
 // 约束：同一个conn不应该同时被多个协程使用
 type ThriftConn struct {
 	Endpoint   string          // 服务端的端点
-	closed     bool            // 为 true 表示已被关闭，这种状态的不能再使用和放回池
+	closed     uint32          // atomic, 为 1 表示已被关闭，这种状态的不能再使用和放回池
+	rawConn    net.Conn        // TCP 连接，用于检测连接是否存活
+	netConn    *ctxConn        // 底层网络连接，启用 TLS 时为 TLS 连接
 	socket     *thrift.TSocket // thrift连接
+	http       *httpTransport  // HTTP 模式下替代 socket
+	sasl       *saslTransport  // 启用 SASL 时包装 socket，并替代 framed 传输
 	usedTime   atomic.Value    // 最近使用时间
 	createTime time.Time       // 链接创建时间
+	expireTime time.Time       // 到达最大存活时间的时刻，零值表示不过期
+	client     *hbase.THBaseServiceClient
+	newClient  func() *hbase.THBaseServiceClient
 	pooled     bool
+	pins       int32 // atomic, 绑定在该连接上的 Scanner 数
 }
 
 func (t *ThriftConn) GetEndpoint() string {
@@ -28,6 +39,11 @@ func (t *ThriftConn) GetSocket() *thrift.TSocket {
 	return t.socket
 }
 
+// CreateTime returns the time the connection was established.
+func (t *ThriftConn) CreateTime() time.Time {
+	return t.createTime
+}
+
 func (t *ThriftConn) UsedTime() time.Time {
 	return t.usedTime.Load().(time.Time)
 }
@@ -50,49 +66,271 @@ func (t *ThriftConn) UpdateUsedTime() int64 {
 
 // Close 关闭thrift连接
 func (t *ThriftConn) Close() error {
-	if t.closed {
+	if !atomic.CompareAndSwapUint32(&t.closed, 0, 1) {
 		return nil
 	}
-	t.closed = true
+	if t.http != nil {
+		return t.http.Close()
+	}
 	return t.socket.Close()
 }
 
+// pinned reports whether a Scanner is bound to the connection. Pinned
+// connections are not reaped for being idle or old.
+func (t *ThriftConn) pinned() bool {
+	return atomic.LoadInt32(&t.pins) > 0
+}
+
 // IsClose 是否关闭
 func (t *ThriftConn) IsClose() bool {
-	return t.closed
+	return atomic.LoadUint32(&t.closed) == 1
 }
 
+// GetHbaseClient returns a new client over the connection. The calls made
+// by HBase do not use it: they share a client built once with the
+// connection, which keeps its buffers and sequence ids across calls. Calls
+// made with the returned client get no deadlines, and must not overlap
+// with other users of the connection.
 func (t *ThriftConn) GetHbaseClient() *hbase.THBaseServiceClient {
-	transF := thrift.NewTFramedTransportFactory(thrift.NewTTransportFactory())
-	protoF := thrift.NewTBinaryProtocolFactoryDefault()
-	useTrans := transF.GetTransport(t.socket)
-	return hbase.NewTHBaseServiceClientFactory(useTrans, protoF)
+	return t.newClient()
 }
 
+// call runs fn on the connection bound to ctx. Each socket read and write
+// must complete within readTimeout and writeTimeout respectively, zero
+// meaning no timeout, and the deadline of ctx bounds them all. Cancelling
+// ctx interrupts a blocked read or write. After an interrupted call the
+// stream may hold a partial response, so the connection must not be reused.
+func (t *ThriftConn) call(ctx context.Context, readTimeout, writeTimeout time.Duration, fn func(hc *hbase.THBaseServiceClient) error) error {
+	if t.http != nil {
+		t.http.begin(ctx, readTimeout, writeTimeout)
+		defer t.http.end()
+		return fn(t.client)
+	}
+
+	deadline, _ := ctx.Deadline()
+	t.netConn.begin(deadline, readTimeout, writeTimeout)
+	defer t.netConn.end()
+
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+				t.netConn.interrupt()
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+
+	return fn(t.client)
+}
+
+// NewThriftConn opens a plaintext connection to the thrift server at
+// endpoint.
 func NewThriftConn(endpoint string, dialTimeout time.Duration) (*ThriftConn, error) {
-	var err error
-	var socket *thrift.TSocket
+	return newThriftConn(context.Background(), &Options{Addr: endpoint, DialTimeout: dialTimeout, BufferSize: defaultBufferSize})
+}
 
-	if dialTimeout > 0 {
-		socket, err = thrift.NewTSocketTimeout(endpoint, dialTimeout)
-	} else {
-		socket, err = thrift.NewTSocket(endpoint)
+// newThriftConn opens a connection to the thrift server at opt.Addr, with
+// opt.Dialer if set, over TLS if opt.TLSConfig is set, or over HTTP if
+// opt.HTTP is, and runs the SASL negotiation if opt.SASL is set. The dial,
+// TLS handshake and SASL negotiation are bounded by DialTimeout, and
+// aborted when ctx is done.
+func newThriftConn(ctx context.Context, opt *Options) (*ThriftConn, error) {
+	if opt.HTTP {
+		return newHTTPConn(opt)
 	}
 
+	if opt.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.DialTimeout)
+		defer cancel()
+	}
+	raw, err := dialContext(opt)(ctx, "tcp", opt.Addr)
 	if err != nil {
 		return nil, err
 	}
 
-	err = socket.Open()
-	if err != nil {
-		return nil, err
+	// ctx 结束时关闭连接，中断 TLS 握手与 SASL 协商
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = raw.Close()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	conn, err := setupConn(ctx, raw, opt)
+	close(stop)
+	// 套接字截止时间可能先于 ctx 到期，此时的超时也归于 ctx
+	if <-interrupted || err != nil && ctxErr(ctx) != nil {
+		if err == nil {
+			_ = conn.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: ctxErr(ctx)}
+	}
+	return conn, err
+}
+
+// setupConn runs the TLS handshake and SASL negotiation of opt on raw, the
+// network connection just dialed, within the deadline of ctx.
+func setupConn(ctx context.Context, raw net.Conn, opt *Options) (*ThriftConn, error) {
+	deadline, _ := ctx.Deadline()
+	nc := raw
+	if opt.TLSConfig != nil {
+		var err error
+		if nc, err = tlsHandshake(raw, opt.Addr, opt.TLSConfig, deadline); err != nil {
+			_ = raw.Close()
+			return nil, err
+		}
 	}
+
+	netConn := &ctxConn{Conn: nc}
 	conn := &ThriftConn{
-		Endpoint:   endpoint,
-		closed:     false,
-		socket:     socket,
+		Endpoint:   opt.Addr,
+		rawConn:    raw,
+		netConn:    netConn,
+		socket:     thrift.NewTSocketFromConnTimeout(netConn, 0),
 		createTime: time.Now(),
 	}
 	_ = conn.UpdateUsedTime()
+
+	if opt.SASL != nil {
+		if err := conn.authenticate(opt, deadline); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err := conn.initClient(opt); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
 	return conn, nil
 }
+
+// dialContext returns the function opening the network connections of
+// opt: opt.Dialer, within DialTimeout, if set, or else a TCP dialer.
+func dialContext(opt *Options) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if opt.Dialer == nil {
+		return (&net.Dialer{Timeout: opt.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if opt.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opt.DialTimeout)
+			defer cancel()
+		}
+		conn, err := opt.Dialer(ctx, network, addr)
+		if _, ok := err.(*net.OpError); err != nil && !ok {
+			// 与默认拨号的错误一致，使其被视为连接失败而非调用方的 ctx 错误
+			err = &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return conn, err
+	}
+}
+
+// authenticate runs the SASL negotiation of opt.SASL before deadline.
+func (t *ThriftConn) authenticate(opt *Options, deadline time.Time) error {
+	host, _, err := net.SplitHostPort(opt.Addr)
+	if err != nil {
+		return err
+	}
+	client, err := opt.SASL(host)
+	if err != nil {
+		return &Error{Kind: ErrAuthFailed, Msg: err.Error(), Err: err}
+	}
+
+	t.netConn.begin(deadline, 0, 0)
+	defer t.netConn.end()
+
+	sasl := newSASLTransport(t.socket, client)
+	if err := sasl.negotiate(); err != nil {
+		return err
+	}
+	t.sasl = sasl
+	return nil
+}
+
+// aLongTimeAgo is a deadline in the past, used to unblock pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ctxConn sets the socket deadline before every read and write, so a call
+// deadline and the read and write timeouts all apply, and lets a cancelled
+// context interrupt a blocked read or write.
+type ctxConn struct {
+	net.Conn
+
+	mu           sync.Mutex
+	readTimeout  time.Duration // 单次读超时
+	writeTimeout time.Duration // 单次写超时
+	deadline     time.Time     // 当前调用的截止时间
+	interrupted  bool
+}
+
+func (c *ctxConn) begin(deadline time.Time, readTimeout, writeTimeout time.Duration) {
+	c.mu.Lock()
+	c.deadline = deadline
+	c.readTimeout = readTimeout
+	c.writeTimeout = writeTimeout
+	c.interrupted = false
+	c.mu.Unlock()
+}
+
+func (c *ctxConn) end() {
+	c.mu.Lock()
+	c.deadline = time.Time{}
+	c.readTimeout = 0
+	c.writeTimeout = 0
+	c.mu.Unlock()
+}
+
+func (c *ctxConn) interrupt() {
+	c.mu.Lock()
+	c.interrupted = true
+	_ = c.Conn.SetDeadline(aLongTimeAgo)
+	c.mu.Unlock()
+}
+
+// ioDeadline must be called with c.mu held.
+func (c *ctxConn) ioDeadline(timeout time.Duration) time.Time {
+	if c.interrupted {
+		return aLongTimeAgo
+	}
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if !c.deadline.IsZero() && (d.IsZero() || c.deadline.Before(d)) {
+		d = c.deadline
+	}
+	return d
+}
+
+func (c *ctxConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	err := c.Conn.SetReadDeadline(c.ioDeadline(c.readTimeout))
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *ctxConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	err := c.Conn.SetWriteDeadline(c.ioDeadline(c.writeTimeout))
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
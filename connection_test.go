@@ -0,0 +1,104 @@
+package gohbase
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestDialer(t *testing.T) {
+	dialed := 0
+	hb := NewHBase(&Options{
+		Addr: "thrift1:9090",
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed++
+			client, server := net.Pipe()
+			go serveThrift(server, &fakeHandler{})
+			return client, nil
+		},
+		PoolSize: 1,
+	})
+	defer hb.Close()
+
+	for i := 0; i < 2; i++ {
+		r, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(r.Row) != "row" {
+			t.Fatalf("Get returned row %q, want %q", r.Row, "row")
+		}
+	}
+	if dialed != 1 {
+		t.Errorf("dialed %d connections, want 1", dialed)
+	}
+}
+
+func TestDialCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  *Options
+	}{
+		{"dial", &Options{
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		}},
+		{"sasl", &Options{
+			// 服务端不应答，SASL 协商一直阻塞
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				client, _ := net.Pipe()
+				return client, nil
+			},
+			SASL: NewPlainSASL("", "alice", "secret"),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := tc.opt
+			opt.Addr = "thrift1:9090"
+			opt.DialTimeout = time.Hour
+			opt.PoolSize = 1
+			opt.init()
+			pool := NewThriftConnPool(opt)
+			defer pool.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if _, err := pool.GetContext(ctx); err != context.DeadlineExceeded {
+				t.Errorf("GetContext = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("GetContext returned after %s", d)
+			}
+			if s := pool.State(); s == StateDown {
+				t.Errorf("pool is %s after a cancelled dial", s)
+			}
+		})
+	}
+}
+
+func TestConnCloseConcurrent(t *testing.T) {
+	cn, err := NewThriftConn(newTestServer(t, &fakeHandler{}), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = cn.Close()
+			if !cn.IsClose() {
+				t.Error("IsClose = false after Close")
+			}
+		}()
+	}
+	wg.Wait()
+}
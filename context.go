@@ -0,0 +1,117 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"context"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	idempotentKey ctxKey = iota
+	readTimeoutKey
+	writeTimeoutKey
+	doAsKey
+	waitKey
+)
+
+// WithIdempotent returns a context telling the client that calls made with
+// it are safe to send more than once, so they are retried on failure even
+// if the command itself is not idempotent, like Increment or Append.
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	v, _ := ctx.Value(idempotentKey).(bool)
+	return v
+}
+
+// WithReadTimeout returns a context overriding Options.ReadTimeout for the
+// calls made with it, e.g. to give a long scan more time than point gets.
+// A zero or negative d disables the timeout.
+func WithReadTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, readTimeoutKey, d)
+}
+
+// WithWriteTimeout returns a context overriding Options.WriteTimeout for the
+// calls made with it. A zero or negative d disables the timeout.
+func WithWriteTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, writeTimeoutKey, d)
+}
+
+// ioTimeouts returns the socket read and write timeouts for a call made
+// with ctx.
+func ioTimeouts(ctx context.Context, opt *Options) (readTimeout, writeTimeout time.Duration) {
+	readTimeout, writeTimeout = opt.ReadTimeout, opt.WriteTimeout
+	if d, ok := ctx.Value(readTimeoutKey).(time.Duration); ok {
+		readTimeout = d
+	}
+	if d, ok := ctx.Value(writeTimeoutKey).(time.Duration); ok {
+		writeTimeout = d
+	}
+	return readTimeout, writeTimeout
+}
+
+// WithUser returns a context making the calls made with it on behalf of
+// user, like the clients returned by HBase.As. An empty user makes them
+// as the authenticated user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, doAsKey, user)
+}
+
+// doAsUser returns the user a call made with ctx is made on behalf of,
+// empty for the authenticated user.
+func doAsUser(ctx context.Context) string {
+	v, _ := ctx.Value(doAsKey).(string)
+	return v
+}
+
+// withWait returns ctx bounding the waits of the calls made with it, for a
+// connection or before a retry, by wait instead.
+func withWait(ctx, wait context.Context) context.Context {
+	return context.WithValue(ctx, waitKey, wait)
+}
+
+// waitContext returns the context bounding the waits of a call made with
+// ctx.
+func waitContext(ctx context.Context) context.Context {
+	if wait, ok := ctx.Value(waitKey).(context.Context); ok {
+		return wait
+	}
+	return ctx
+}
+
+// detachedContext carries the values of a call, but neither its deadline
+// nor its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detach returns a context with the values and deadline of ctx, which is
+// not cancelled with ctx.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detachedContext{ctx}, deadline)
+	}
+	return context.WithCancel(detachedContext{ctx})
+}
+
+// ctxErr is ctx.Err, except that it reports context.DeadlineExceeded as soon
+// as the deadline of ctx passed: a socket deadline set from it can expire
+// before the timer of ctx fires.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// ErrDoAsUnsupported is the kind of the errors returned for calls made on
+// behalf of a user, with HBase.As or WithUser, by a client not in HTTP
+// mode: the thrift servers only accept the doAs parameter over HTTP.
+var ErrDoAsUnsupported = errors.New("HBase: impersonation requires HTTP mode")
+
+// userClient is an HBase making every call of another one on behalf of
+// user. It shares the pools of the other client.
+type userClient struct {
+	hb   HBase
+	user string
+}
+
+func newUserClient(hb HBase, user string) HBase {
+	return &userClient{hb: hb, user: user}
+}
+
+// Exists implements HBase
+func (c *userClient) Exists(table []byte, tget *hbase.TGet) (r bool, err error) {
+	return c.ExistsContext(context.Background(), table, tget)
+}
+
+// ExistsContext implements HBase
+func (c *userClient) ExistsContext(ctx context.Context, table []byte, tget *hbase.TGet) (r bool, err error) {
+	return c.hb.ExistsContext(WithUser(ctx, c.user), table, tget)
+}
+
+// Get implements HBase
+func (c *userClient) Get(table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
+	return c.GetContext(context.Background(), table, tget)
+}
+
+// GetContext implements HBase
+func (c *userClient) GetContext(ctx context.Context, table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
+	return c.hb.GetContext(WithUser(ctx, c.user), table, tget)
+}
+
+// GetMultiple implements HBase
+func (c *userClient) GetMultiple(table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
+	return c.GetMultipleContext(context.Background(), table, tgets)
+}
+
+// GetMultipleContext implements HBase
+func (c *userClient) GetMultipleContext(ctx context.Context, table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
+	return c.hb.GetMultipleContext(WithUser(ctx, c.user), table, tgets)
+}
+
+// Put implements HBase
+func (c *userClient) Put(table []byte, tput *hbase.TPut) (err error) {
+	return c.PutContext(context.Background(), table, tput)
+}
+
+// PutContext implements HBase
+func (c *userClient) PutContext(ctx context.Context, table []byte, tput *hbase.TPut) (err error) {
+	return c.hb.PutContext(WithUser(ctx, c.user), table, tput)
+}
+
+// CheckAndPut implements HBase
+func (c *userClient) CheckAndPut(table, row, family, qualifier, value []byte, tput *hbase.TPut) (r bool, err error) {
+	return c.CheckAndPutContext(context.Background(), table, row, family, qualifier, value, tput)
+}
+
+// CheckAndPutContext implements HBase
+func (c *userClient) CheckAndPutContext(ctx context.Context, table, row, family, qualifier, value []byte, tput *hbase.TPut) (r bool, err error) {
+	return c.hb.CheckAndPutContext(WithUser(ctx, c.user), table, row, family, qualifier, value, tput)
+}
+
+// PutMultiple implements HBase
+func (c *userClient) PutMultiple(table []byte, tputs []*hbase.TPut) (err error) {
+	return c.PutMultipleContext(context.Background(), table, tputs)
+}
+
+// PutMultipleContext implements HBase
+func (c *userClient) PutMultipleContext(ctx context.Context, table []byte, tputs []*hbase.TPut) (err error) {
+	return c.hb.PutMultipleContext(WithUser(ctx, c.user), table, tputs)
+}
+
+// DeleteSingle implements HBase
+func (c *userClient) DeleteSingle(table []byte, tdelete *hbase.TDelete) (err error) {
+	return c.DeleteSingleContext(context.Background(), table, tdelete)
+}
+
+// DeleteSingleContext implements HBase
+func (c *userClient) DeleteSingleContext(ctx context.Context, table []byte, tdelete *hbase.TDelete) (err error) {
+	return c.hb.DeleteSingleContext(WithUser(ctx, c.user), table, tdelete)
+}
+
+// DeleteMultiple implements HBase
+func (c *userClient) DeleteMultiple(table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
+	return c.DeleteMultipleContext(context.Background(), table, tdeletes)
+}
+
+// DeleteMultipleContext implements HBase
+func (c *userClient) DeleteMultipleContext(ctx context.Context, table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
+	return c.hb.DeleteMultipleContext(WithUser(ctx, c.user), table, tdeletes)
+}
+
+// CheckAndDelete implements HBase
+func (c *userClient) CheckAndDelete(table, row, family, qualifier, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
+	return c.CheckAndDeleteContext(context.Background(), table, row, family, qualifier, value, tdelete)
+}
+
+// CheckAndDeleteContext implements HBase
+func (c *userClient) CheckAndDeleteContext(ctx context.Context, table, row, family, qualifier, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
+	return c.hb.CheckAndDeleteContext(WithUser(ctx, c.user), table, row, family, qualifier, value, tdelete)
+}
+
+// Increment implements HBase
+func (c *userClient) Increment(table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
+	return c.IncrementContext(context.Background(), table, tincrement)
+}
+
+// IncrementContext implements HBase
+func (c *userClient) IncrementContext(ctx context.Context, table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
+	return c.hb.IncrementContext(WithUser(ctx, c.user), table, tincrement)
+}
+
+// Append implements HBase
+func (c *userClient) Append(table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	return c.AppendContext(context.Background(), table, tappend)
+}
+
+// AppendContext implements HBase
+func (c *userClient) AppendContext(ctx context.Context, table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	return c.hb.AppendContext(WithUser(ctx, c.user), table, tappend)
+}
+
+// OpenScanner implements HBase
+func (c *userClient) OpenScanner(table []byte, tscan *hbase.TScan) (r int32, err error) {
+	return c.OpenScannerContext(context.Background(), table, tscan)
+}
+
+// OpenScannerContext implements HBase
+func (c *userClient) OpenScannerContext(ctx context.Context, table []byte, tscan *hbase.TScan) (r int32, err error) {
+	return c.hb.OpenScannerContext(WithUser(ctx, c.user), table, tscan)
+}
+
+// GetScannerRows implements HBase
+func (c *userClient) GetScannerRows(scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
+	return c.GetScannerRowsContext(context.Background(), scannerId, numRows)
+}
+
+// GetScannerRowsContext implements HBase
+func (c *userClient) GetScannerRowsContext(ctx context.Context, scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
+	return c.hb.GetScannerRowsContext(WithUser(ctx, c.user), scannerId, numRows)
+}
+
+// CloseScanner implements HBase
+func (c *userClient) CloseScanner(scannerId int32) (err error) {
+	return c.CloseScannerContext(context.Background(), scannerId)
+}
+
+// CloseScannerContext implements HBase
+func (c *userClient) CloseScannerContext(ctx context.Context, scannerId int32) (err error) {
+	return c.hb.CloseScannerContext(WithUser(ctx, c.user), scannerId)
+}
+
+// Scan implements HBase
+func (c *userClient) Scan(table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	return c.ScanContext(context.Background(), table, tscan)
+}
+
+// ScanContext implements HBase
+func (c *userClient) ScanContext(ctx context.Context, table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	return c.hb.ScanContext(WithUser(ctx, c.user), table, tscan)
+}
+
+// MutateRow implements HBase
+func (c *userClient) MutateRow(table []byte, trowMutations *hbase.TRowMutations) (err error) {
+	return c.MutateRowContext(context.Background(), table, trowMutations)
+}
+
+// MutateRowContext implements HBase
+func (c *userClient) MutateRowContext(ctx context.Context, table []byte, trowMutations *hbase.TRowMutations) (err error) {
+	return c.hb.MutateRowContext(WithUser(ctx, c.user), table, trowMutations)
+}
+
+// GetScannerResults implements HBase
+func (c *userClient) GetScannerResults(table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
+	return c.GetScannerResultsContext(context.Background(), table, tscan, numRows)
+}
+
+// GetScannerResultsContext implements HBase
+func (c *userClient) GetScannerResultsContext(ctx context.Context, table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
+	return c.hb.GetScannerResultsContext(WithUser(ctx, c.user), table, tscan, numRows)
+}
+
+// GetRegionLocation implements HBase
+func (c *userClient) GetRegionLocation(table, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
+	return c.GetRegionLocationContext(context.Background(), table, row, reload)
+}
+
+// GetRegionLocationContext implements HBase
+func (c *userClient) GetRegionLocationContext(ctx context.Context, table, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
+	return c.hb.GetRegionLocationContext(WithUser(ctx, c.user), table, row, reload)
+}
+
+// GetAllRegionLocations implements HBase
+func (c *userClient) GetAllRegionLocations(table []byte) (r []*hbase.THRegionLocation, err error) {
+	return c.GetAllRegionLocationsContext(context.Background(), table)
+}
+
+// GetAllRegionLocationsContext implements HBase
+func (c *userClient) GetAllRegionLocationsContext(ctx context.Context, table []byte) (r []*hbase.THRegionLocation, err error) {
+	return c.hb.GetAllRegionLocationsContext(WithUser(ctx, c.user), table)
+}
+
+// PoolStats implements HBase, for the shared pools.
+func (c *userClient) PoolStats() *Stats {
+	return c.hb.PoolStats()
+}
+
+// EndpointStats implements HBase, for the shared pools.
+func (c *userClient) EndpointStats() map[string]*Stats {
+	return c.hb.EndpointStats()
+}
+
+// PoolState implements HBase, for the shared pools.
+func (c *userClient) PoolState() PoolState {
+	return c.hb.PoolState()
+}
+
+// As implements HBase
+func (c *userClient) As(user string) HBase {
+	return c.hb.As(user)
+}
+
+// Close implements HBase. It does nothing: the pools belong to the client
+// c was derived from.
+func (c *userClient) Close() error {
+	return nil
+}
@@ -2,9 +2,169 @@
 
 package gohbase
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
 
 var (
-	ErrClosed      = errors.New("HBase: client is closed")
-	ErrPoolTimeout = errors.New("HBase: connection pool timeout")
+	ErrClosed        = errors.New("HBase: client is closed")
+	ErrPoolTimeout   = errors.New("HBase: connection pool timeout")
+	ErrPoolExhausted = errors.New("HBase: connection pool exhausted")
+	ErrBreakerOpen   = errors.New("HBase: circuit breaker is open")
+
+	ErrTableNotFound      = errors.New("HBase: table not found")
+	ErrNoSuchColumnFamily = errors.New("HBase: no such column family")
+	ErrRegionTooBusy      = errors.New("HBase: region too busy")
+	ErrRegionMoved        = errors.New("HBase: region moved or not online")
+	ErrScannerExpired     = errors.New("HBase: scanner expired")
+	ErrConnBroken         = errors.New("HBase: connection broken")
+	ErrIllegalArgument    = errors.New("HBase: illegal argument")
 )
+
+// Error wraps an error returned by the thrift server or the transport with
+// the kind of failure it denotes. Use errors.Is with the Err* values to test
+// the kind, and errors.As to reach the underlying *hbase.TIOError,
+// *hbase.TIllegalArgument or thrift.TTransportException.
+type Error struct {
+	Kind      error  // one of the Err* values, nil if not recognized
+	Exception string // Java exception class reported by the server, if any
+	Msg       string // message of the underlying error
+	Err       error  // underlying error
+}
+
+func (e *Error) Error() string {
+	if e.Kind == nil {
+		return "HBase: " + e.Msg
+	}
+	return e.Kind.Error() + ": " + e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// exceptionKinds maps the simple names of server side Java exceptions to
+// the kind of failure they denote.
+var exceptionKinds = map[string]error{
+	"TableNotFoundException":       ErrTableNotFound,
+	"NoSuchColumnFamilyException":  ErrNoSuchColumnFamily,
+	"RegionTooBusyException":       ErrRegionTooBusy,
+	"NotServingRegionException":    ErrRegionMoved,
+	"RegionMovedException":         ErrRegionMoved,
+	"RegionOpeningException":       ErrRegionMoved,
+	"ServerNotRunningYetException": ErrRegionMoved,
+	"UnknownScannerException":      ErrScannerExpired,
+	"ScannerTimeoutException":      ErrScannerExpired,
+	"LeaseException":               ErrScannerExpired,
+}
+
+// javaException matches a, possibly qualified, Java exception class name.
+var javaException = regexp.MustCompile(`(?:[a-z_$][\w$]*\.)*([A-Z][\w$]*(?:Exception|Error))`)
+
+// invalidScanner is the message of the TIllegalArgument the thrift2 server
+// raises for a scanner id it does not know, e.g. after the lease expired.
+var invalidScanner = regexp.MustCompile(`(?i)invalid scanner id`)
+
+// parseException returns the first Java exception named in msg with a known
+// kind, or else the first one named at all.
+func parseException(msg string) (exception string, kind error) {
+	for _, m := range javaException.FindAllStringSubmatch(msg, -1) {
+		if k, ok := exceptionKinds[m[1]]; ok {
+			return m[0], k
+		}
+		if exception == "" {
+			exception = m[0]
+		}
+	}
+	return exception, nil
+}
+
+// wrapError classifies err as returned by a thrift call.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+
+	switch e := err.(type) {
+	case *hbase.TIOError:
+		exception, kind := parseException(e.GetMessage())
+		return &Error{Kind: kind, Exception: exception, Msg: e.GetMessage(), Err: err}
+	case *hbase.TIllegalArgument:
+		exception, kind := parseException(e.GetMessage())
+		if kind == nil {
+			kind = ErrIllegalArgument
+			if invalidScanner.MatchString(e.GetMessage()) {
+				kind = ErrScannerExpired
+			}
+		}
+		return &Error{Kind: kind, Exception: exception, Msg: e.GetMessage(), Err: err}
+	case thrift.TTransportException:
+		if status, ok := e.Err().(httpStatusError); ok {
+			return &Error{Kind: status.kind(), Msg: err.Error(), Err: err}
+		}
+		return &Error{Kind: ErrConnBroken, Msg: err.Error(), Err: err}
+	case thrift.TProtocolException, net.Error:
+		return &Error{Kind: ErrConnBroken, Msg: err.Error(), Err: err}
+	case thrift.TApplicationException:
+		if e.TypeId() == thrift.BAD_SEQUENCE_ID {
+			return &Error{Kind: ErrConnBroken, Msg: err.Error(), Err: err}
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &Error{Kind: ErrConnBroken, Msg: err.Error(), Err: err}
+	}
+	return err
+}
+
+// nilArgument returns the error of a call given a nil name argument.
+func nilArgument(name string) error {
+	return &Error{Kind: ErrIllegalArgument, Msg: name + " is nil"}
+}
+
+// IsRetryable reports whether a failed call may succeed if sent again:
+// the connection broke, the pool was busy, or the region was moving or
+// overloaded.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrConnBroken) ||
+		errors.Is(err, ErrPoolTimeout) ||
+		errors.Is(err, ErrRegionMoved) ||
+		errors.Is(err, ErrRegionTooBusy)
+}
+
+// isServerError reports whether err was raised by the server while
+// handling the call, as opposed to a failure to reach it.
+func isServerError(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Kind != ErrConnBroken && e.Kind != ErrProtocolMismatch && e.Kind != ErrBreakerOpen
+}
+
+// isBadConn reports whether the connection a call failed on must be closed
+// instead of going back to the pool. Errors reported by the server leave the
+// stream in sync and keep the connection.
+func isBadConn(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return true
+	}
+	return errors.Is(err, ErrConnBroken)
+}
@@ -0,0 +1,92 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestParseException(t *testing.T) {
+	for _, tc := range []struct {
+		msg       string
+		exception string
+		kind      error
+	}{
+		{"org.apache.hadoop.hbase.TableNotFoundException: t", "org.apache.hadoop.hbase.TableNotFoundException", ErrTableNotFound},
+		{"TableNotFoundException: t", "TableNotFoundException", ErrTableNotFound},
+		{"org.apache.hadoop.hbase.regionserver.NoSuchColumnFamilyException: Column family x does not exist", "org.apache.hadoop.hbase.regionserver.NoSuchColumnFamilyException", ErrNoSuchColumnFamily},
+		// 第一个已知的异常优先于更早出现的未知异常
+		{"java.io.IOException: failed\nCaused by: org.apache.hadoop.hbase.NotServingRegionException: r", "org.apache.hadoop.hbase.NotServingRegionException", ErrRegionMoved},
+		{"org.apache.hadoop.hbase.ipc.ServerNotRunningYetException: starting", "org.apache.hadoop.hbase.ipc.ServerNotRunningYetException", ErrRegionMoved},
+		{"org.apache.hadoop.hbase.regionserver.LeaseException: lease 12 does not exist", "org.apache.hadoop.hbase.regionserver.LeaseException", ErrScannerExpired},
+		{"java.io.IOException: boom", "java.io.IOException", nil},
+		{"org.apache.hadoop.hbase.Outer$InnerError: x", "org.apache.hadoop.hbase.Outer$InnerError", nil},
+		{"no exception here", "", nil},
+	} {
+		exception, kind := parseException(tc.msg)
+		if exception != tc.exception || kind != tc.kind {
+			t.Errorf("parseException(%q) = %q, %v, want %q, %v", tc.msg, exception, kind, tc.exception, tc.kind)
+		}
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	ioError := func(msg string) error { return &hbase.TIOError{Message: &msg} }
+	illegalArgument := func(msg string) error { return &hbase.TIllegalArgument{Message: &msg} }
+	opError := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		kind      error // nil 表示不包装为 *Error
+		exception string
+		retryable bool
+	}{
+		{"table not found", ioError("org.apache.hadoop.hbase.TableNotFoundException: t"), ErrTableNotFound, "org.apache.hadoop.hbase.TableNotFoundException", false},
+		{"region moved", ioError("org.apache.hadoop.hbase.exceptions.RegionMovedException: r"), ErrRegionMoved, "org.apache.hadoop.hbase.exceptions.RegionMovedException", true},
+		{"region too busy", ioError("org.apache.hadoop.hbase.RegionTooBusyException: r"), ErrRegionTooBusy, "org.apache.hadoop.hbase.RegionTooBusyException", true},
+		{"unknown scanner", ioError("org.apache.hadoop.hbase.UnknownScannerException: 7"), ErrScannerExpired, "org.apache.hadoop.hbase.UnknownScannerException", false},
+		{"invalid scanner id", illegalArgument("Invalid scanner Id"), ErrScannerExpired, "", false},
+		{"illegal argument", illegalArgument("row is empty"), ErrIllegalArgument, "", false},
+		{"illegal argument with exception", illegalArgument("org.apache.hadoop.hbase.TableNotFoundException: t"), ErrTableNotFound, "org.apache.hadoop.hbase.TableNotFoundException", false},
+		{"transport", thrift.NewTTransportException(thrift.TIMED_OUT, "i/o timeout"), ErrConnBroken, "", true},
+		{"protocol", thrift.NewTProtocolException(errors.New("bad version")), ErrConnBroken, "", true},
+		{"net", opError, ErrConnBroken, "", true},
+		{"eof", io.EOF, ErrConnBroken, "", true},
+		{"unexpected eof", io.ErrUnexpectedEOF, ErrConnBroken, "", true},
+		{"bad sequence id", thrift.NewTApplicationException(thrift.BAD_SEQUENCE_ID, "out of order"), ErrConnBroken, "", true},
+		{"application", thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, "no such method"), nil, "", false},
+		{"canceled", context.Canceled, nil, "", false},
+		{"deadline", context.DeadlineExceeded, nil, "", false},
+	} {
+		err := wrapError(tc.err)
+		var e *Error
+		if tc.kind == nil {
+			if err != tc.err {
+				t.Errorf("%s: wrapError = %v, want %v unchanged", tc.name, err, tc.err)
+			}
+		} else if !errors.As(err, &e) || e.Kind != tc.kind || e.Exception != tc.exception {
+			t.Errorf("%s: wrapError = %#v, want kind %v and exception %q", tc.name, err, tc.kind, tc.exception)
+		} else if !errors.Is(err, tc.kind) || !errors.Is(err, tc.err) {
+			t.Errorf("%s: wrapError = %v, want it to match %v and %v", tc.name, err, tc.kind, tc.err)
+		}
+		if IsRetryable(err) != tc.retryable {
+			t.Errorf("%s: IsRetryable(%v) = %v, want %v", tc.name, err, !tc.retryable, tc.retryable)
+		}
+		if wrapError(err) != err {
+			t.Errorf("%s: wrapError is not idempotent", tc.name)
+		}
+	}
+
+	if !IsRetryable(ErrPoolTimeout) || IsRetryable(ErrPoolExhausted) || IsRetryable(ErrClosed) {
+		t.Error("IsRetryable of the pool errors is wrong")
+	}
+	if IsRetryable(nil) {
+		t.Error("IsRetryable(nil) = true")
+	}
+}
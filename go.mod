@@ -2,4 +2,8 @@ module github.com/tianxingpan/gohbase
 
 go 1.16
 
-require git.apache.org/thrift.git v0.0.0-20190309152529-a9b748bb0e02
+require (
+	git.apache.org/thrift.git v0.0.0-20190309152529-a9b748bb0e02
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
+)
@@ -1,8 +1,20 @@
 // Package gohbase provides a pool of hbase clients
 package gohbase
 
-import "github.com/tianxingpan/gohbase/hbase"
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
 
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// HBase is a client of the HBase thrift2 service.
+//
+// Every method has a variant with a Context suffix. The context bounds the
+// wait for a pooled connection and the socket I/O of the call; cancelling it
+// aborts a pending wait and interrupts a blocked read or write.
 type HBase interface {
 	// Test for the existence of columns in the table, as specified in the TGet.
 	//
@@ -12,6 +24,8 @@ type HBase interface {
 	//  - Table: the table to check on
 	//  - Tget: the TGet to check for
 	Exists(table []byte, tget *hbase.TGet) (r bool, err error)
+	// ExistsContext is Exists with a context.
+	ExistsContext(ctx context.Context, table []byte, tget *hbase.TGet) (r bool, err error)
 	// Method for getting data from a row.
 	//
 	// If the row cannot be found an empty Result is returned.
@@ -23,6 +37,8 @@ type HBase interface {
 	//  - Table: the table to get from
 	//  - Tget: the TGet to fetch
 	Get(table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error)
+	// GetContext is Get with a context.
+	GetContext(ctx context.Context, table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error)
 	// Method for getting multiple rows.
 	//
 	// If a row cannot be found there will be a null
@@ -37,12 +53,16 @@ type HBase interface {
 	// will have the Results at corresponding positions
 	// or null if there was an error
 	GetMultiple(table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error)
+	// GetMultipleContext is GetMultiple with a context.
+	GetMultipleContext(ctx context.Context, table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error)
 	// Commit a TPut to a table.
 	//
 	// Parameters:
 	//  - Table: the table to put data in
 	//  - Tput: the TPut to put
 	Put(table []byte, tput *hbase.TPut) (err error)
+	// PutContext is Put with a context.
+	PutContext(ctx context.Context, table []byte, tput *hbase.TPut) (err error)
 	// Atomically checks if a row/family/qualifier value matches the expected
 	// value. If it does, it adds the TPut.
 	//
@@ -58,12 +78,16 @@ type HBase interface {
 	// column in question
 	//  - Tput: the TPut to put if the check succeeds\
 	CheckAndPut(table, row, family, qualifier, value []byte, tput *hbase.TPut) (r bool, err error)
+	// CheckAndPutContext is CheckAndPut with a context.
+	CheckAndPutContext(ctx context.Context, table, row, family, qualifier, value []byte, tput *hbase.TPut) (r bool, err error)
 	// Commit a List of Puts to the table.
 	//
 	// Parameters:
 	//  - Table: the table to put data in
 	//  - Tputs: a list of TPuts to commit
 	PutMultiple(table []byte, tputs []*hbase.TPut) (err error)
+	// PutMultipleContext is PutMultiple with a context.
+	PutMultipleContext(ctx context.Context, table []byte, tputs []*hbase.TPut) (err error)
 	// Deletes as specified by the TDelete.
 	//
 	// Note: "delete" is a reserved keyword and cannot be used in Thrift
@@ -73,6 +97,8 @@ type HBase interface {
 	//  - Table: the table to delete from
 	//  - Tdelete: the TDelete to delete
 	DeleteSingle(table []byte, tdelete *hbase.TDelete) (err error)
+	// DeleteSingleContext is DeleteSingle with a context.
+	DeleteSingleContext(ctx context.Context, table []byte, tdelete *hbase.TDelete) (err error)
 	// Bulk commit a List of TDeletes to the table.
 	//
 	// Throws a TIOError if any of the deletes fail.
@@ -83,6 +109,8 @@ type HBase interface {
 	//  - Table: the table to delete from
 	//  - Tdeletes: list of TDeletes to delete
 	DeleteMultiple(table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error)
+	// DeleteMultipleContext is DeleteMultiple with a context.
+	DeleteMultipleContext(ctx context.Context, table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error)
 	// Atomically checks if a row/family/qualifier value matches the expected
 	// value. If it does, it adds the delete.
 	//
@@ -98,14 +126,20 @@ type HBase interface {
 	// column in question
 	//  - Tdelete: the TDelete to execute if the check succeeds
 	CheckAndDelete(table, row, family, qualifier, value []byte, tdelete *hbase.TDelete) (r bool, err error)
+	// CheckAndDeleteContext is CheckAndDelete with a context.
+	CheckAndDeleteContext(ctx context.Context, table, row, family, qualifier, value []byte, tdelete *hbase.TDelete) (r bool, err error)
 	// Parameters:
 	//  - Table: the table to increment the value on
 	//  - Tincrement: the TIncrement to increment
 	Increment(table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error)
+	// IncrementContext is Increment with a context.
+	IncrementContext(ctx context.Context, table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error)
 	// Parameters:
 	//  - Table: the table to append the value on
 	//  - Tappend: the TAppend to append
 	Append(table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error)
+	// AppendContext is Append with a context.
+	AppendContext(ctx context.Context, table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error)
 	// Get a Scanner for the provided TScan object.
 	//
 	// @return Scanner Id to be used with other scanner procedures
@@ -114,6 +148,8 @@ type HBase interface {
 	//  - Table: the table to get the Scanner for
 	//  - Tscan: the scan object to get a Scanner for
 	OpenScanner(table []byte, tscan *hbase.TScan) (r int32, err error)
+	// OpenScannerContext is OpenScanner with a context.
+	OpenScannerContext(ctx context.Context, table []byte, tscan *hbase.TScan) (r int32, err error)
 	// Grabs multiple rows from a Scanner.
 	//
 	// @return Between zero and numRows TResults
@@ -122,6 +158,8 @@ type HBase interface {
 	//  - ScannerId: the Id of the Scanner to return rows from. This is an Id returned from the openScanner function.
 	//  - NumRows: number of rows to return
 	GetScannerRows(scannerId int32, numRows int32) (r []*hbase.TResult_, err error)
+	// GetScannerRowsContext is GetScannerRows with a context.
+	GetScannerRowsContext(ctx context.Context, scannerId int32, numRows int32) (r []*hbase.TResult_, err error)
 	// Closes the scanner. Should be called to free server side resources timely.
 	// Typically close once the scanner is not needed anymore, i.e. after looping
 	// over it to get all the required rows.
@@ -129,12 +167,27 @@ type HBase interface {
 	// Parameters:
 	//  - ScannerId: the Id of the Scanner to close *
 	CloseScanner(scannerId int32) (err error)
+	// CloseScannerContext is CloseScanner with a context.
+	CloseScannerContext(ctx context.Context, scannerId int32) (err error)
+	// Scan opens a scanner for the provided TScan object and returns a
+	// handle bound to the connection it was opened on, so that its rows are
+	// fetched from the same thrift server. Prefer it to OpenScanner when
+	// several servers, or a load balancer in front of them, are used.
+	//
+	// Parameters:
+	//  - Table: the table to get the Scanner for
+	//  - Tscan: the scan object to get a Scanner for
+	Scan(table []byte, tscan *hbase.TScan) (*Scanner, error)
+	// ScanContext is Scan with a context.
+	ScanContext(ctx context.Context, table []byte, tscan *hbase.TScan) (*Scanner, error)
 	// mutateRow performs multiple mutations atomically on a single row.
 	//
 	// Parameters:
 	//  - Table: table to apply the mutations
 	//  - TrowMutations: mutations to apply
 	MutateRow(table []byte, trowMutations *hbase.TRowMutations) (err error)
+	// MutateRowContext is MutateRow with a context.
+	MutateRowContext(ctx context.Context, table []byte, trowMutations *hbase.TRowMutations) (err error)
 	// Get results for the provided TScan object.
 	// This helper function opens a scanner, get the results and close the scanner.
 	//
@@ -145,6 +198,8 @@ type HBase interface {
 	//  - Tscan: the scan object to get a Scanner for
 	//  - NumRows: number of rows to return
 	GetScannerResults(table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error)
+	// GetScannerResultsContext is GetScannerResults with a context.
+	GetScannerResultsContext(ctx context.Context, table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error)
 	// Given a table and a row get the location of the region that
 	// would contain the given row key.
 	//
@@ -156,263 +211,506 @@ type HBase interface {
 	//  - Row
 	//  - Reload
 	GetRegionLocation(table, row []byte, reload bool) (r *hbase.THRegionLocation, err error)
+	// GetRegionLocationContext is GetRegionLocation with a context.
+	GetRegionLocationContext(ctx context.Context, table, row []byte, reload bool) (r *hbase.THRegionLocation, err error)
 	// Get all of the region locations for a given table.
 	//
 	//
 	// Parameters:
 	//  - Table
 	GetAllRegionLocations(table []byte) (r []*hbase.THRegionLocation, err error)
+	// GetAllRegionLocationsContext is GetAllRegionLocations with a context.
+	GetAllRegionLocationsContext(ctx context.Context, table []byte) (r []*hbase.THRegionLocation, err error)
+
+	// PoolStats returns connection pool stats, added up over all endpoints.
+	// Its BreakerState is open if the breakers of all endpoints are,
+	// half-open if some are open or half-open, and closed otherwise.
+	PoolStats() *Stats
+	// EndpointStats returns the connection pool stats of each endpoint,
+	// by address.
+	EndpointStats() map[string]*Stats
+	// PoolState returns the health state of the connection pools: healthy
+	// if all endpoints are, down if all are, degraded otherwise.
+	PoolState() PoolState
+
+	// As returns a client making every call on behalf of user, for thrift
+	// servers run in HTTP mode with hbase.thrift.support.proxyuser: the
+	// calls carry the doAs parameter, and the servers check that the
+	// authenticated user may impersonate user. It shares the pools of this
+	// client, and closing it does nothing. Not in HTTP mode, its calls fail
+	// with ErrDoAsUnsupported. The region locations loaded in the background
+	// for Options.HostMapper are read as the authenticated user, not user.
+	As(user string) HBase
 
 	// Close HBase client
 	Close() (err error)
 }
 
+// NewHBase returns a client of the thrift servers of opt. If opt sets an
+// unknown protocol or transport, or a transport that cannot be used with
+// the other options, every call of the client fails with an error of kind
+// ErrIllegalArgument. The client keeps a copy of opt, which is not modified.
 func NewHBase(opt *Options) HBase {
-	return &hBaseCMD{
-		opt:            opt,
-		thriftConnPool: NewThriftConnPool(opt),
+	o := *opt
+	opt = &o
+	opt.init()
+	h := &hBaseCMD{
+		opt:     opt,
+		cluster: newCluster(opt),
+		err:     checkStack(opt),
+	}
+	if opt.HostMapper != nil {
+		h.regions = newRegionCache(opt.HostMapper)
 	}
+	return h
 }
 
 type hBaseCMD struct {
-	opt            *Options
-	thriftConnPool *ThriftConnPool
+	opt     *Options
+	cluster *cluster
+	regions *regionCache // nil 表示不按 region 所在主机路由
+	err     error        // Options 无效时所有调用返回的错误
+
+	latencies latencyWindow // 读请求耗时，用于自适应的 HedgeDelay
+	hedges    uint32        // atomic
+	hedgeWins uint32        // atomic
 }
 
-// Append implements HBase
-func (h *hBaseCMD) Append(table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
+// process runs the command op, retrying it according to Options.MaxRetries.
+func (h *hBaseCMD) process(ctx context.Context, op string, fn func(hc *hbase.THBaseServiceClient) error) error {
+	return h.processRow(ctx, op, nil, nil, fn)
+}
+
+// processRow is process for a command on a single row of table, sent to the
+// thrift server on the host of its region if Options.HostMapper is set.
+// Retryable errors are retried for any op when the request was never sent,
+// and only for idempotent ops or calls made with WithIdempotent once it was.
+func (h *hBaseCMD) processRow(ctx context.Context, op string, table, row []byte, fn func(hc *hbase.THBaseServiceClient) error) error {
+	canRetry := idempotent[op] || isIdempotent(ctx)
+
+	var lastErr error
+	for attempt := 0; attempt <= h.opt.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := retryBackoff(attempt-1, h.opt.MinRetryBackoff, h.opt.MaxRetryBackoff)
+			if err := sleep(waitContext(ctx), backoff); err != nil {
+				return lastErr
+			}
+		}
+
+		sent, err := h.processOnce(ctx, table, row, fn)
+		if err == nil || !IsRetryable(err) || (sent && !canRetry) {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// processOnce borrows a connection, runs fn on it and gives the connection
+// back. sent reports whether the request may have reached the server.
+func (h *hBaseCMD) processOnce(ctx context.Context, table, row []byte, fn func(hc *hbase.THBaseServiceClient) error) (sent bool, err error) {
+	pool, cn, err := h.getConn(waitContext(ctx), table, row)
 	if err != nil {
+		err = wrapError(err)
+		h.cluster.observe(pool, err, 0)
+		return false, err
+	}
+
+	err = h.run(ctx, pool, cn, fn)
+	if h.regions != nil && row != nil && errors.Is(err, ErrRegionMoved) {
+		h.regions.invalidate(table, row)
+	}
+	return true, err
+}
+
+// getConn borrows a connection from the pool routed to for row of table.
+// A pool removed from the cluster may be drained and closed between its
+// pick and the borrow; the call is routed again then.
+func (h *hBaseCMD) getConn(ctx context.Context, table, row []byte) (*ThriftConnPool, *ThriftConn, error) {
+	if h.err != nil {
+		return nil, nil, h.err
+	}
+	if user := doAsUser(ctx); user != "" && !h.opt.HTTP {
+		return nil, nil, &Error{Kind: ErrDoAsUnsupported, Msg: "cannot call as " + user}
+	}
+	for {
+		pool := h.route(table, row)
+		cn, err := pool.GetContext(ctx)
+		if err == ErrClosed && !h.cluster.isClosed() {
+			continue
+		}
+		return pool, cn, err
+	}
+}
+
+// run runs fn on cn, borrowed from pool, and gives cn back. The latency
+// observed for the endpoint excludes the wait for cn.
+func (h *hBaseCMD) run(ctx context.Context, pool *ThriftConnPool, cn *ThriftConn, fn func(hc *hbase.THBaseServiceClient) error) error {
+	start := time.Now()
+	readTimeout, writeTimeout := ioTimeouts(ctx, h.opt)
+	err := wrapError(cn.call(ctx, readTimeout, writeTimeout, fn))
+	if ctx.Err() != nil && isBadConn(err) {
+		// 调用被中断，连接上可能残留未读完的响应；服务端已完整返回的错误保留
+		err = ctx.Err()
+	}
+	err = pool.checkProtocol(err)
+	releaseConn(pool, cn, err)
+	h.cluster.observe(pool, err, time.Since(start))
+	return err
+}
+
+// releaseConn returns cn to pool, unless err shows that the stream is
+// broken or out of sync, in which case cn is closed.
+func releaseConn(pool *ThriftConnPool, cn *ThriftConn, err error) {
+	if isBadConn(err) {
+		pool.Remove(cn, err)
 		return
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.Append(table, tappend)
+	pool.Put(cn)
+}
+
+// Append implements HBase
+func (h *hBaseCMD) Append(table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	return h.AppendContext(context.Background(), table, tappend)
+}
+
+// AppendContext implements HBase
+func (h *hBaseCMD) AppendContext(ctx context.Context, table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	if tappend == nil {
+		return nil, nilArgument("tappend")
+	}
+	err = h.processRow(ctx, "append", table, tappend.Row, func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.Append(table, tappend)
+		return
+	})
 	return
 }
 
 // CheckAndDelete implements HBase
 func (h *hBaseCMD) CheckAndDelete(table []byte, row []byte, family []byte, qualifier []byte, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.CheckAndDeleteContext(context.Background(), table, row, family, qualifier, value, tdelete)
+}
+
+// CheckAndDeleteContext implements HBase
+func (h *hBaseCMD) CheckAndDeleteContext(ctx context.Context, table []byte, row []byte, family []byte, qualifier []byte, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
+	if tdelete == nil {
+		return false, nilArgument("tdelete")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.CheckAndDelete(table, row, family, qualifier, value, tdelete)
+	err = h.processRow(ctx, "checkAndDelete", table, row, func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.CheckAndDelete(table, row, family, qualifier, value, tdelete)
+		return
+	})
 	return
 }
 
 // CheckAndPut implements HBase
 func (h *hBaseCMD) CheckAndPut(table []byte, row []byte, family []byte, qualifier []byte, value []byte, tput *hbase.TPut) (r bool, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.CheckAndPutContext(context.Background(), table, row, family, qualifier, value, tput)
+}
+
+// CheckAndPutContext implements HBase
+func (h *hBaseCMD) CheckAndPutContext(ctx context.Context, table []byte, row []byte, family []byte, qualifier []byte, value []byte, tput *hbase.TPut) (r bool, err error) {
+	if tput == nil {
+		return false, nilArgument("tput")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.CheckAndPut(table, row, family, qualifier, value, tput)
+	err = h.processRow(ctx, "checkAndPut", table, row, func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.CheckAndPut(table, row, family, qualifier, value, tput)
+		return
+	})
 	return
 }
 
 // CloseScanner implements HBase
 func (h *hBaseCMD) CloseScanner(scannerId int32) (err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	err = hc.CloseScanner(scannerId)
-	return
+	return h.CloseScannerContext(context.Background(), scannerId)
+}
+
+// CloseScannerContext implements HBase
+func (h *hBaseCMD) CloseScannerContext(ctx context.Context, scannerId int32) (err error) {
+	return h.process(ctx, "closeScanner", func(hc *hbase.THBaseServiceClient) error {
+		return hc.CloseScanner(scannerId)
+	})
 }
 
 // DeleteMultiple implements HBase
 func (h *hBaseCMD) DeleteMultiple(table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.DeleteMultipleContext(context.Background(), table, tdeletes)
+}
+
+// DeleteMultipleContext implements HBase
+func (h *hBaseCMD) DeleteMultipleContext(ctx context.Context, table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
+	err = h.process(ctx, "deleteMultiple", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.DeleteMultiple(table, tdeletes)
 		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.DeleteMultiple(table, tdeletes)
+	})
 	return
 }
 
 // DeleteSingle implements HBase
 func (h *hBaseCMD) DeleteSingle(table []byte, tdelete *hbase.TDelete) (err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.DeleteSingleContext(context.Background(), table, tdelete)
+}
+
+// DeleteSingleContext implements HBase
+func (h *hBaseCMD) DeleteSingleContext(ctx context.Context, table []byte, tdelete *hbase.TDelete) (err error) {
+	if tdelete == nil {
+		return nilArgument("tdelete")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	err = hc.DeleteSingle(table, tdelete)
-	return
+	return h.processRow(ctx, "deleteSingle", table, tdelete.Row, func(hc *hbase.THBaseServiceClient) error {
+		return hc.DeleteSingle(table, tdelete)
+	})
 }
 
 // Exists implements HBase
 func (h *hBaseCMD) Exists(table []byte, tget *hbase.TGet) (r bool, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.ExistsContext(context.Background(), table, tget)
+}
+
+// ExistsContext implements HBase
+func (h *hBaseCMD) ExistsContext(ctx context.Context, table []byte, tget *hbase.TGet) (r bool, err error) {
+	if tget == nil {
+		return false, nilArgument("tget")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.Exists(table, tget)
+	v, err := h.hedged(ctx, tget.Row, func(ctx context.Context, row []byte) (interface{}, error) {
+		var r bool
+		err := h.processRow(ctx, "exists", table, row, func(hc *hbase.THBaseServiceClient) (err error) {
+			r, err = hc.Exists(table, tget)
+			return
+		})
+		return r, err
+	})
+	r, _ = v.(bool)
 	return
 }
 
 // Get implements HBase
 func (h *hBaseCMD) Get(table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.GetContext(context.Background(), table, tget)
+}
+
+// GetContext implements HBase
+func (h *hBaseCMD) GetContext(ctx context.Context, table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
+	if tget == nil {
+		return nil, nilArgument("tget")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.Get(table, tget)
+	v, err := h.hedged(ctx, tget.Row, func(ctx context.Context, row []byte) (interface{}, error) {
+		var r *hbase.TResult_
+		err := h.processRow(ctx, "get", table, row, func(hc *hbase.THBaseServiceClient) (err error) {
+			r, err = hc.Get(table, tget)
+			return
+		})
+		return r, err
+	})
+	r, _ = v.(*hbase.TResult_)
 	return
 }
 
 // GetAllRegionLocations implements HBase
 func (h *hBaseCMD) GetAllRegionLocations(table []byte) (r []*hbase.THRegionLocation, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.GetAllRegionLocationsContext(context.Background(), table)
+}
+
+// GetAllRegionLocationsContext implements HBase
+func (h *hBaseCMD) GetAllRegionLocationsContext(ctx context.Context, table []byte) (r []*hbase.THRegionLocation, err error) {
+	err = h.process(ctx, "getAllRegionLocations", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.GetAllRegionLocations(table)
 		return
+	})
+	if err == nil && h.regions != nil {
+		h.regions.set(table, r)
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.GetAllRegionLocations(table)
 	return
 }
 
 // GetMultiple implements HBase
 func (h *hBaseCMD) GetMultiple(table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.GetMultiple(table, tgets)
+	return h.GetMultipleContext(context.Background(), table, tgets)
+}
+
+// GetMultipleContext implements HBase
+func (h *hBaseCMD) GetMultipleContext(ctx context.Context, table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
+	v, err := h.hedged(ctx, nil, func(ctx context.Context, _ []byte) (interface{}, error) {
+		var r []*hbase.TResult_
+		err := h.process(ctx, "getMultiple", func(hc *hbase.THBaseServiceClient) (err error) {
+			r, err = hc.GetMultiple(table, tgets)
+			return
+		})
+		return r, err
+	})
+	r, _ = v.([]*hbase.TResult_)
 	return
 }
 
 // GetRegionLocation implements HBase
 func (h *hBaseCMD) GetRegionLocation(table []byte, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.GetRegionLocationContext(context.Background(), table, row, reload)
+}
+
+// GetRegionLocationContext implements HBase
+func (h *hBaseCMD) GetRegionLocationContext(ctx context.Context, table []byte, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
+	err = h.process(ctx, "getRegionLocation", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.GetRegionLocation(table, row, reload)
 		return
+	})
+	if err == nil && h.regions != nil {
+		h.regions.put(table, r)
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.GetRegionLocation(table, row, reload)
 	return
 }
 
 // GetScannerResults implements HBase
 func (h *hBaseCMD) GetScannerResults(table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.GetScannerResultsContext(context.Background(), table, tscan, numRows)
+}
+
+// GetScannerResultsContext implements HBase
+func (h *hBaseCMD) GetScannerResultsContext(ctx context.Context, table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
+	err = h.process(ctx, "getScannerResults", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.GetScannerResults(table, tscan, numRows)
 		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.GetScannerResults(table, tscan, numRows)
+	})
 	return
 }
 
 // GetScannerRows implements HBase
 func (h *hBaseCMD) GetScannerRows(scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.GetScannerRowsContext(context.Background(), scannerId, numRows)
+}
+
+// GetScannerRowsContext implements HBase
+func (h *hBaseCMD) GetScannerRowsContext(ctx context.Context, scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
+	err = h.process(ctx, "getScannerRows", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.GetScannerRows(scannerId, numRows)
 		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.GetScannerRows(scannerId, numRows)
+	})
 	return
 }
 
 // Increment implements HBase
 func (h *hBaseCMD) Increment(table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.IncrementContext(context.Background(), table, tincrement)
+}
+
+// IncrementContext implements HBase
+func (h *hBaseCMD) IncrementContext(ctx context.Context, table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
+	if tincrement == nil {
+		return nil, nilArgument("tincrement")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.Increment(table, tincrement)
+	err = h.processRow(ctx, "increment", table, tincrement.Row, func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.Increment(table, tincrement)
+		return
+	})
 	return
 }
 
 // MutateRow implements HBase
 func (h *hBaseCMD) MutateRow(table []byte, trowMutations *hbase.TRowMutations) (err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.MutateRowContext(context.Background(), table, trowMutations)
+}
+
+// MutateRowContext implements HBase
+func (h *hBaseCMD) MutateRowContext(ctx context.Context, table []byte, trowMutations *hbase.TRowMutations) (err error) {
+	if trowMutations == nil {
+		return nilArgument("trowMutations")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	err = hc.MutateRow(table, trowMutations)
-	return
+	return h.processRow(ctx, "mutateRow", table, trowMutations.Row, func(hc *hbase.THBaseServiceClient) error {
+		return hc.MutateRow(table, trowMutations)
+	})
 }
 
 // OpenScanner implements HBase
 func (h *hBaseCMD) OpenScanner(table []byte, tscan *hbase.TScan) (r int32, err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
+	return h.OpenScannerContext(context.Background(), table, tscan)
+}
+
+// OpenScannerContext implements HBase
+func (h *hBaseCMD) OpenScannerContext(ctx context.Context, table []byte, tscan *hbase.TScan) (r int32, err error) {
+	err = h.process(ctx, "openScanner", func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.OpenScanner(table, tscan)
 		return
-	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	r, err = hc.OpenScanner(table, tscan)
+	})
 	return
 }
 
 // Put implements HBase
 func (h *hBaseCMD) Put(table []byte, tput *hbase.TPut) (err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
-	if err != nil {
-		return
+	return h.PutContext(context.Background(), table, tput)
+}
+
+// PutContext implements HBase
+func (h *hBaseCMD) PutContext(ctx context.Context, table []byte, tput *hbase.TPut) (err error) {
+	if tput == nil {
+		return nilArgument("tput")
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	err = hc.Put(table, tput)
-	return
+	return h.processRow(ctx, "put", table, tput.Row, func(hc *hbase.THBaseServiceClient) error {
+		return hc.Put(table, tput)
+	})
 }
 
 // PutMultiple implements HBase
 func (h *hBaseCMD) PutMultiple(table []byte, tputs []*hbase.TPut) (err error) {
-	var cn *ThriftConn
-	cn, err = h.thriftConnPool.Get()
+	return h.PutMultipleContext(context.Background(), table, tputs)
+}
+
+// PutMultipleContext implements HBase
+func (h *hBaseCMD) PutMultipleContext(ctx context.Context, table []byte, tputs []*hbase.TPut) (err error) {
+	return h.process(ctx, "putMultiple", func(hc *hbase.THBaseServiceClient) error {
+		return hc.PutMultiple(table, tputs)
+	})
+}
+
+// Scan implements HBase
+func (h *hBaseCMD) Scan(table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	return h.ScanContext(context.Background(), table, tscan)
+}
+
+// ScanContext implements HBase
+func (h *hBaseCMD) ScanContext(ctx context.Context, table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	pool, cn, err := h.getConn(ctx, nil, nil)
 	if err != nil {
+		err = wrapError(err)
+		h.cluster.observe(pool, err, 0)
+		return nil, err
+	}
+
+	s := &Scanner{h: h, pool: pool, cn: cn, user: doAsUser(ctx)}
+	err = h.run(ctx, pool, cn, func(hc *hbase.THBaseServiceClient) (err error) {
+		s.id, err = hc.OpenScanner(table, tscan)
+		if err == nil {
+			// 在放回连接池之前绑定，避免连接被回收
+			atomic.AddInt32(&cn.pins, 1)
+		}
 		return
+	})
+	if err != nil {
+		return nil, err
 	}
-	defer h.thriftConnPool.Put(cn)
-	hc := cn.GetHbaseClient()
-	err = hc.PutMultiple(table, tputs)
-	return
+	return s, nil
+}
+
+// PoolStats implements HBase
+func (h *hBaseCMD) PoolStats() *Stats {
+	stats := h.cluster.Stats()
+	stats.Hedges = atomic.LoadUint32(&h.hedges)
+	stats.HedgeWins = atomic.LoadUint32(&h.hedgeWins)
+	return stats
+}
+
+// EndpointStats implements HBase
+func (h *hBaseCMD) EndpointStats() map[string]*Stats {
+	return h.cluster.EndpointStats()
+}
+
+// PoolState implements HBase
+func (h *hBaseCMD) PoolState() PoolState {
+	return h.cluster.State()
+}
+
+// As implements HBase
+func (h *hBaseCMD) As(user string) HBase {
+	return newUserClient(h, user)
 }
 
 func (h *hBaseCMD) Close() error {
-	return h.thriftConnPool.Close()
+	return h.cluster.Close()
 }
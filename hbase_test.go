@@ -0,0 +1,201 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// fakeHandler is a thrift server handler answering Get with the row asked
+// for. Other methods are not implemented.
+type fakeHandler struct {
+	hbase.THBaseService
+}
+
+func (h *fakeHandler) Get(table []byte, tget *hbase.TGet) (*hbase.TResult_, error) {
+	return &hbase.TResult_{Row: tget.Row}, nil
+}
+
+// serveThrift serves handler on conn with the framed transport and the
+// binary protocol, until conn is closed.
+func serveThrift(conn net.Conn, handler hbase.THBaseService) {
+	defer conn.Close()
+	proc := hbase.NewTHBaseServiceProcessor(handler)
+	trans := thrift.NewTFramedTransport(thrift.NewTSocketFromConnTimeout(conn, 0))
+	prot := thrift.NewTBinaryProtocolFactoryDefault().GetProtocol(trans)
+	for {
+		if ok, err := proc.Process(prot, prot); !ok || err != nil {
+			return
+		}
+	}
+}
+
+// newTestServer starts a thrift server of handler on a local port and
+// returns its address.
+func newTestServer(tb testing.TB, handler hbase.THBaseService) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go serveThrift(conn, handler)
+		}
+	}()
+	tb.Cleanup(func() {
+		_ = ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	return ln.Addr().String()
+}
+
+func TestNilArgument(t *testing.T) {
+	hb := NewHBase(&Options{Addr: newTestServer(t, &fakeHandler{})})
+	defer hb.Close()
+
+	if _, err := hb.Get([]byte("t"), nil); !errors.Is(err, ErrIllegalArgument) {
+		t.Errorf("Get(nil) = %v, want ErrIllegalArgument", err)
+	}
+	if err := hb.Put([]byte("t"), nil); !errors.Is(err, ErrIllegalArgument) {
+		t.Errorf("Put(nil) = %v, want ErrIllegalArgument", err)
+	}
+}
+
+func TestNewHBaseCopiesOptions(t *testing.T) {
+	opt := &Options{Addr: newTestServer(t, &fakeHandler{})}
+	hb := NewHBase(opt)
+	defer hb.Close()
+
+	if opt.PoolSize != 0 || opt.MaxRetries != 0 || opt.DialTimeout != 0 {
+		t.Errorf("NewHBase set the defaults in the options of the caller: %+v", opt)
+	}
+	if h := hb.(*hBaseCMD); h.opt.MaxRetries != 3 {
+		t.Errorf("MaxRetries = %d, want 3 by default", h.opt.MaxRetries)
+	}
+
+	hb = NewHBase(&Options{Addr: opt.Addr, MaxRetries: -1})
+	defer hb.Close()
+	if h := hb.(*hBaseCMD); h.opt.MaxRetries != 0 {
+		t.Errorf("MaxRetries = %d with -1, want 0", h.opt.MaxRetries)
+	}
+}
+
+// missingTableHandler fails every Get with a TableNotFoundException.
+type missingTableHandler struct {
+	fakeHandler
+}
+
+func (h *missingTableHandler) Get(table []byte, tget *hbase.TGet) (*hbase.TResult_, error) {
+	msg := "org.apache.hadoop.hbase.TableNotFoundException: " + string(table)
+	return nil, &hbase.TIOError{Message: &msg}
+}
+
+// canceledContext is done as far as Err tells, but never interrupts the
+// call, as if it was cancelled right after the answer was read.
+type canceledContext struct {
+	context.Context
+}
+
+func (canceledContext) Err() error { return context.Canceled }
+
+func TestServerErrorAfterCancel(t *testing.T) {
+	hb := NewHBase(&Options{Addr: newTestServer(t, &missingTableHandler{}), PoolSize: 1})
+	defer hb.Close()
+
+	_, err := hb.GetContext(canceledContext{context.Background()}, []byte("t"), &hbase.TGet{Row: []byte("row")})
+	if !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Get = %v, want ErrTableNotFound", err)
+	}
+	if s := hb.PoolStats(); s.IdleConns != 1 {
+		t.Errorf("pool has %d idle connections, want 1", s.IdleConns)
+	}
+}
+
+func TestInvalidStack(t *testing.T) {
+	for _, opt := range []*Options{
+		{Protocol: Protocol(7)},
+		{Transport: Transport(7)},
+		{Transport: TransportBuffered, HTTP: true},
+		{Transport: TransportBuffered, SASL: NewPlainSASL("", "alice", "secret")},
+	} {
+		opt.Addr = newTestServer(t, &fakeHandler{})
+		hb := NewHBase(opt)
+		_, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")})
+		if !errors.Is(err, ErrIllegalArgument) || IsRetryable(err) {
+			t.Errorf("Get with %s protocol, %s transport = %v, want ErrIllegalArgument", opt.Protocol, opt.Transport, err)
+		}
+		_ = hb.Close()
+	}
+}
+
+// BenchmarkGet measures a Get through the pool. The allocations of the
+// test server, in the same process, are included.
+func BenchmarkGet(b *testing.B) {
+	hb := NewHBase(&Options{Addr: newTestServer(b, &fakeHandler{}), PoolSize: 1})
+	defer hb.Close()
+	tget := &hbase.TGet{Row: []byte("row")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hb.Get([]byte("t"), tget); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkConnGet compares a Get with the client shared by the calls of a
+// connection, and with a client built for the call as GetHbaseClient does.
+func BenchmarkConnGet(b *testing.B) {
+	addr := newTestServer(b, &fakeHandler{})
+	for _, bc := range []struct {
+		name   string
+		client func(cn *ThriftConn, hc *hbase.THBaseServiceClient) *hbase.THBaseServiceClient
+	}{
+		{"shared", func(cn *ThriftConn, hc *hbase.THBaseServiceClient) *hbase.THBaseServiceClient { return hc }},
+		{"new", func(cn *ThriftConn, hc *hbase.THBaseServiceClient) *hbase.THBaseServiceClient {
+			return cn.GetHbaseClient()
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cn, err := NewThriftConn(addr, time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cn.Close()
+			tget := &hbase.TGet{Row: []byte("row")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := cn.call(context.Background(), 0, 0, func(hc *hbase.THBaseServiceClient) error {
+					_, err := bc.client(cn, hc).Get([]byte("t"), tget)
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hedgeWindow is the number of read latencies the adaptive hedge delay
+	// is computed from.
+	hedgeWindow = 256
+	// hedgeMinSamples is the number of reads needed before the adaptive
+	// hedge delay is known. Reads are not hedged until then.
+	hedgeMinSamples = 20
+)
+
+// latencyWindow keeps the latencies of the last hedgeWindow reads and their
+// 95th percentile.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [hedgeWindow]time.Duration
+	n       int
+	p95     int64 // atomic
+}
+
+func (w *latencyWindow) record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.n%hedgeWindow] = d
+	w.n++
+	// 每 16 个样本重新计算一次，避免每次调用都排序
+	if w.n == hedgeMinSamples || (w.n > hedgeMinSamples && w.n%16 == 0) {
+		n := w.n
+		if n > hedgeWindow {
+			n = hedgeWindow
+		}
+		sorted := make([]time.Duration, n)
+		copy(sorted, w.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		atomic.StoreInt64(&w.p95, int64(sorted[n*95/100]))
+	}
+}
+
+func (w *latencyWindow) percentile95() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.p95))
+}
+
+type hedgeResult struct {
+	v     interface{}
+	err   error
+	hedge bool
+}
+
+// hedgeDelay returns the delay after which a read is hedged, 0 if reads
+// are not hedged.
+func (h *hBaseCMD) hedgeDelay() time.Duration {
+	if h.opt.HedgeDelay == -1 {
+		return h.latencies.percentile95()
+	}
+	return h.opt.HedgeDelay
+}
+
+// hedged runs attempt for a read of row of table and, if it has not
+// answered within the hedge delay, runs it again concurrently. The first
+// successful answer wins. The other attempt is abandoned if it still waits
+// for a connection or a retry, and else left to finish in the background,
+// so that its connection goes back to the pool. The hedge is not routed by
+// row, so that it may reach another server.
+//
+// attempt must not share its results with the other attempt.
+func (h *hBaseCMD) hedged(ctx context.Context, row []byte, attempt func(ctx context.Context, row []byte) (interface{}, error)) (interface{}, error) {
+	delay := h.hedgeDelay()
+	start := time.Now()
+	record := func() {
+		if h.opt.HedgeDelay == -1 {
+			h.latencies.record(time.Since(start))
+		}
+	}
+
+	if delay <= 0 {
+		v, err := attempt(ctx, row)
+		if err == nil {
+			record()
+		}
+		return v, err
+	}
+
+	// 请求发出后，只在 hedged 返回前调用方取消 ctx 时才中断
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	run := func(row []byte, hedge bool) context.CancelFunc {
+		wait, abandon := context.WithCancel(ctx)
+		call, cancel := detach(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			v, err := attempt(withWait(call, wait), row)
+			cancel()
+			results <- hedgeResult{v: v, err: err, hedge: hedge}
+		}()
+		return abandon
+	}
+	interrupt := func() error {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		return ctx.Err()
+	}
+
+	// 返回时放弃仍在等待的另一次调用
+	abandon := run(row, false)
+	defer abandon()
+
+	timer := time.NewTimer(delay)
+	select {
+	case res := <-results:
+		timer.Stop()
+		if res.err == nil {
+			record()
+		}
+		return res.v, res.err
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, interrupt()
+	}
+
+	atomic.AddUint32(&h.hedges, 1)
+	abandonHedge := run(nil, true)
+	defer abandonHedge()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		var res hedgeResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, interrupt()
+		}
+		if res.err == nil {
+			if res.hedge {
+				atomic.AddUint32(&h.hedgeWins, 1)
+			}
+			record()
+			return res.v, nil
+		}
+		if err == nil || !res.hedge {
+			err = res.err
+		}
+	}
+	return nil, err
+}
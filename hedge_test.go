@@ -0,0 +1,53 @@
+package gohbase
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// slowHandler answers the first Get after delay, and the others at once.
+type slowHandler struct {
+	fakeHandler
+	delay time.Duration
+	calls int32
+}
+
+func (h *slowHandler) Get(table []byte, tget *hbase.TGet) (*hbase.TResult_, error) {
+	if atomic.AddInt32(&h.calls, 1) == 1 {
+		time.Sleep(h.delay)
+	}
+	return h.fakeHandler.Get(table, tget)
+}
+
+func TestHedgeKeepsLoserConn(t *testing.T) {
+	hb := NewHBase(&Options{
+		Addr:       newTestServer(t, &slowHandler{delay: 200 * time.Millisecond}),
+		HedgeDelay: 20 * time.Millisecond,
+		PoolSize:   2,
+	})
+	defer hb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	r, err := hb.GetContext(ctx, []byte("t"), &hbase.TGet{Row: []byte("row")})
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Row) != "row" {
+		t.Fatalf("Get returned row %q, want %q", r.Row, "row")
+	}
+
+	// 被超越的请求在后台完成，连接放回连接池
+	time.Sleep(300 * time.Millisecond)
+	s := hb.PoolStats()
+	if s.HedgeWins != 1 {
+		t.Errorf("HedgeWins = %d, want 1", s.HedgeWins)
+	}
+	if s.BrokenConns != 0 || s.IdleConns != 2 {
+		t.Errorf("pool has %d idle and %d broken connections, want 2 and 0", s.IdleConns, s.BrokenConns)
+	}
+}
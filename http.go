@@ -0,0 +1,212 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// maxDrain is the number of unread response bytes drained, so that the
+// HTTP connection can be reused, before giving up on it.
+const maxDrain = 4096
+
+// newHTTPClient returns the http.Client shared by the pools of a client in
+// HTTP mode. It keeps up to PoolSize idle connections per server alive.
+func newHTTPClient(opt *Options) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialContext(opt),
+			TLSClientConfig:     opt.TLSConfig,
+			MaxIdleConnsPerHost: opt.PoolSize,
+			IdleConnTimeout:     opt.IdleTimeout,
+		},
+	}
+}
+
+// httpStatusError is the error of a response with a status other than OK.
+type httpStatusError int
+
+func (e httpStatusError) Error() string {
+	return "HTTP response code: " + strconv.Itoa(int(e))
+}
+
+// kind returns the kind of the error. A request refused by the server, for
+// another reason than a timeout or throttling, would be refused again.
+func (e httpStatusError) kind() error {
+	switch {
+	case e == http.StatusUnauthorized || e == http.StatusForbidden:
+		return ErrAuthFailed
+	case e == http.StatusRequestTimeout || e == http.StatusTooManyRequests:
+		return ErrConnBroken
+	case e >= 400 && e < 500:
+		return ErrIllegalArgument
+	}
+	return ErrConnBroken
+}
+
+// httpTransport is a thrift transport sending each call as an HTTP POST
+// request, like thrift.THttpClient, but bound to the context of the call.
+type httpTransport struct {
+	client *http.Client
+	url    string
+	header http.Header
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	user   string // 当前调用的 doAs 用户
+	wbuf   bytes.Buffer
+	resp   *http.Response
+	body   *bufio.Reader // 读取 resp.Body，在各次调用间复用
+}
+
+func newHTTPTransport(opt *Options) *httpTransport {
+	scheme := "http"
+	if opt.TLSConfig != nil {
+		scheme = "https"
+	}
+	return &httpTransport{
+		client: opt.HTTPClient,
+		url:    scheme + "://" + opt.Addr + opt.HTTPPath,
+		header: opt.HTTPHeader,
+		ctx:    context.Background(),
+		body:   bufio.NewReaderSize(nil, opt.BufferSize),
+	}
+}
+
+// begin binds the transport to the call with ctx, and to its doAs user if
+// any. Without HTTP level read and write deadlines, the sum of the read and
+// write timeouts set bounds the whole request.
+func (t *httpTransport) begin(ctx context.Context, readTimeout, writeTimeout time.Duration) {
+	t.ctx, t.cancel = ctx, nil
+	t.user = doAsUser(ctx)
+	var timeout time.Duration
+	if readTimeout > 0 {
+		timeout += readTimeout
+	}
+	if writeTimeout > 0 {
+		timeout += writeTimeout
+	}
+	if timeout > 0 {
+		t.ctx, t.cancel = context.WithTimeout(ctx, timeout)
+	}
+	t.wbuf.Reset()
+}
+
+// end releases the response of the call, keeping its connection alive if
+// possible.
+func (t *httpTransport) end() {
+	t.closeResponse()
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.ctx, t.cancel = context.Background(), nil
+	t.user = ""
+}
+
+func (t *httpTransport) closeResponse() {
+	if t.resp == nil {
+		return
+	}
+	_, _ = io.CopyN(ioutil.Discard, t.resp.Body, maxDrain)
+	_ = t.resp.Body.Close()
+	t.resp = nil
+	t.body.Reset(nil)
+}
+
+func (t *httpTransport) Open() error {
+	return nil
+}
+
+func (t *httpTransport) IsOpen() bool {
+	return true
+}
+
+func (t *httpTransport) Close() error {
+	t.closeResponse()
+	return nil
+}
+
+func (t *httpTransport) Read(p []byte) (int, error) {
+	if t.resp == nil {
+		return 0, thrift.NewTTransportException(thrift.NOT_OPEN, "no HTTP response to read from")
+	}
+	n, err := t.body.Read(p)
+	if err != nil && err != io.EOF {
+		return n, thrift.NewTTransportExceptionFromError(err)
+	}
+	return n, err
+}
+
+func (t *httpTransport) Write(p []byte) (int, error) {
+	return t.wbuf.Write(p)
+}
+
+// Flush sends the buffered call and waits for the response headers.
+func (t *httpTransport) Flush() error {
+	t.closeResponse()
+
+	u := t.url
+	if t.user != "" {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "doAs=" + url.QueryEscape(t.user)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(t.wbuf.Bytes()))
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	req = req.WithContext(t.ctx)
+	for k, vs := range t.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/x-thrift")
+	req.Header.Set("Accept", "application/x-thrift")
+	t.wbuf.Reset()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	t.resp = resp
+	t.body.Reset(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return thrift.NewTTransportExceptionFromError(httpStatusError(resp.StatusCode))
+	}
+	return nil
+}
+
+func (t *httpTransport) RemainingBytes() uint64 {
+	const maxSize = ^uint64(0)
+	return maxSize // 响应长度未知
+}
+
+// newHTTPConn returns a connection to the thrift server at opt.Addr in
+// HTTP mode. Network connections are managed by opt.HTTPClient.
+func newHTTPConn(opt *Options) (*ThriftConn, error) {
+	conn := &ThriftConn{
+		Endpoint:   opt.Addr,
+		http:       newHTTPTransport(opt),
+		createTime: time.Now(),
+	}
+	_ = conn.UpdateUsedTime()
+	if err := conn.initClient(opt); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
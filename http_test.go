@@ -0,0 +1,116 @@
+package gohbase
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		kind   error
+	}{
+		{http.StatusUnauthorized, ErrAuthFailed},
+		{http.StatusForbidden, ErrAuthFailed},
+		{http.StatusNotFound, ErrIllegalArgument},
+		{http.StatusTooManyRequests, ErrConnBroken},
+		{http.StatusServiceUnavailable, ErrConnBroken},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		hb := NewHBase(&Options{
+			Addr: strings.TrimPrefix(srv.URL, "http://"),
+			HTTP: true,
+		})
+
+		_, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")})
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("Get answered %d = %v, want %v", tc.status, err, tc.kind)
+		}
+		if IsRetryable(err) != (tc.kind == ErrConnBroken) {
+			t.Errorf("IsRetryable(%v) = %v", err, IsRetryable(err))
+		}
+		_ = hb.Close()
+		srv.Close()
+	}
+}
+
+// newHTTPTestServer starts a thrift server of handler in HTTP mode and
+// returns its address. Each request is passed to seen first.
+func newHTTPTestServer(t *testing.T, handler hbase.THBaseService, seen func(r *http.Request)) string {
+	proc := hbase.NewTHBaseServiceProcessor(handler)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen(r)
+		in := thrift.NewTMemoryBuffer()
+		if _, err := in.ReadFrom(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out := thrift.NewTMemoryBuffer()
+		factory := thrift.NewTBinaryProtocolFactoryDefault()
+		if _, err := proc.Process(factory.GetProtocol(in), factory.GetProtocol(out)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-thrift")
+		_, _ = w.Write(out.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestDoAs(t *testing.T) {
+	var mu sync.Mutex
+	var users []string
+	addr := newHTTPTestServer(t, &fakeHandler{}, func(r *http.Request) {
+		mu.Lock()
+		users = append(users, r.URL.Query().Get("doAs"))
+		mu.Unlock()
+	})
+
+	// 单个连接：代理调用与普通调用共用同一个 httpTransport
+	hb := NewHBase(&Options{Addr: addr, HTTP: true, PoolSize: 1})
+	defer hb.Close()
+	tget := &hbase.TGet{Row: []byte("row")}
+	for _, c := range []HBase{hb.As("alice"), hb, hb.As("bob"), hb} {
+		r, err := c.Get([]byte("t"), tget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(r.Row) != "row" {
+			t.Fatalf("Get returned row %q, want %q", r.Row, "row")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"alice", "", "bob", ""}
+	if strings.Join(users, ",") != strings.Join(want, ",") {
+		t.Errorf("server saw doAs %q, want %q", users, want)
+	}
+	if s := hb.PoolStats(); s.TotalConns != 1 {
+		t.Errorf("pool has %d connections, want 1", s.TotalConns)
+	}
+}
+
+func TestDoAsUnsupported(t *testing.T) {
+	hb := NewHBase(&Options{Addr: newTestServer(t, &fakeHandler{})})
+	defer hb.Close()
+
+	_, err := hb.As("alice").Get([]byte("t"), &hbase.TGet{Row: []byte("row")})
+	var e *Error
+	if !errors.As(err, &e) || !errors.Is(err, ErrDoAsUnsupported) {
+		t.Errorf("Get as alice = %v, want an *Error of kind ErrDoAsUnsupported", err)
+	}
+	if s := hb.PoolStats(); s.TotalConns != 0 {
+		t.Errorf("pool has %d connections, want none", s.TotalConns)
+	}
+}
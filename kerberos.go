@@ -0,0 +1,413 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/etype"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Kerberos is a Kerberos login, from a keytab or a credential cache, which
+// establishes the security contexts of the GSSAPI mechanism:
+//
+//	krb, err := gohbase.NewKeytabKerberos("", "client.keytab", "client@EXAMPLE.COM")
+//	...
+//	defer krb.Close()
+//	opt.SASL = gohbase.NewGSSAPISASL("hbase", "", krb.NewGSSContext)
+//
+// The service tickets are got from the KDC for the first connection to a
+// server, and cached until they expire.
+type Kerberos struct {
+	cfg        *config.Config
+	ccacheFile string // 凭据缓存登录时的文件，keytab 登录时为空
+
+	mu        sync.Mutex
+	cl        *client.Client
+	ccacheMod time.Time
+}
+
+// NewKeytabKerberos logs in principal, e.g. "client@EXAMPLE.COM", or
+// without realm for the default realm, with its key in keytabFile. The
+// login is renewed with the keytab when its ticket expires. krb5Conf is the
+// path of the Kerberos configuration; default is $KRB5_CONFIG, or else
+// /etc/krb5.conf.
+func NewKeytabKerberos(krb5Conf, keytabFile, principal string) (*Kerberos, error) {
+	cfg, err := loadKrb5Conf(krb5Conf)
+	if err != nil {
+		return nil, err
+	}
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return nil, err
+	}
+
+	user, realm := principal, cfg.LibDefaults.DefaultRealm
+	if i := strings.LastIndexByte(principal, '@'); i >= 0 {
+		user, realm = principal[:i], principal[i+1:]
+	}
+	cl := client.NewWithKeytab(user, realm, kt, cfg)
+	if err := cl.Login(); err != nil {
+		cl.Destroy()
+		return nil, err
+	}
+	return &Kerberos{cfg: cfg, cl: cl}, nil
+}
+
+// NewCCacheKerberos uses the login of the credential cache ccacheFile, as
+// left by kinit; default is $KRB5CCNAME, or else /tmp/krb5cc_<uid>. Only
+// caches of the FILE type are read. The cache is read again when it is
+// modified, so that the logins renewed by kinit are used by new
+// connections; once its ticket expires, new connections fail with
+// ErrAuthFailed until then. krb5Conf is as for NewKeytabKerberos.
+func NewCCacheKerberos(krb5Conf, ccacheFile string) (*Kerberos, error) {
+	cfg, err := loadKrb5Conf(krb5Conf)
+	if err != nil {
+		return nil, err
+	}
+	if ccacheFile == "" {
+		ccacheFile = os.Getenv("KRB5CCNAME")
+		if i := strings.IndexByte(ccacheFile, ':'); i >= 0 {
+			if ccacheFile[:i] != "FILE" {
+				return nil, fmt.Errorf("credential cache %s is not supported", ccacheFile)
+			}
+			ccacheFile = ccacheFile[i+1:]
+		}
+		if ccacheFile == "" {
+			ccacheFile = "/tmp/krb5cc_" + strconv.Itoa(os.Getuid())
+		}
+	}
+
+	k := &Kerberos{cfg: cfg, ccacheFile: ccacheFile}
+	info, err := os.Stat(ccacheFile)
+	if err != nil {
+		return nil, err
+	}
+	if k.cl, err = loadCCache(ccacheFile, cfg); err != nil {
+		return nil, err
+	}
+	k.ccacheMod = info.ModTime()
+	return k, nil
+}
+
+func loadKrb5Conf(path string) (*config.Config, error) {
+	if path == "" {
+		path = os.Getenv("KRB5_CONFIG")
+	}
+	if path == "" {
+		path = "/etc/krb5.conf"
+	}
+	return config.Load(path)
+}
+
+func loadCCache(path string, cfg *config.Config) (cl *client.Client, err error) {
+	// gokrb5 解析截断的缓存时会 panic，例如 kinit 正在改写
+	defer func() {
+		if r := recover(); r != nil {
+			cl, err = nil, fmt.Errorf("invalid credential cache %s: %v", path, r)
+		}
+	}()
+	cc, err := credentials.LoadCCache(path)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewFromCCache(cc, cfg)
+}
+
+// client returns the client of the login, from the credential cache read
+// again if it was modified since. If reading fails, e.g. while kinit
+// writes the cache, the previous client is kept.
+func (k *Kerberos) client() *client.Client {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.ccacheFile == "" {
+		return k.cl
+	}
+	info, err := os.Stat(k.ccacheFile)
+	if err != nil || info.ModTime().Equal(k.ccacheMod) {
+		return k.cl
+	}
+	cl, err := loadCCache(k.ccacheFile, k.cfg)
+	if err != nil {
+		return k.cl
+	}
+	// 凭据缓存的客户端不自动续期，无需销毁，进行中的协商仍可使用
+	k.cl, k.ccacheMod = cl, info.ModTime()
+	return k.cl
+}
+
+// NewGSSContext returns a security context for the service principal
+// service/host, for NewGSSAPISASL. The context requests mutual
+// authentication, and uses the per-message tokens of RFC 4121, so the
+// service tickets must be of an AES encryption type.
+func (k *Kerberos) NewGSSContext(service, host string) (GSSContext, error) {
+	return &krb5Context{cl: k.client(), spn: service + "/" + host}, nil
+}
+
+// Close ends the login, and the renewal of a keytab login. Connections
+// already authenticated are not affected.
+func (k *Kerberos) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cl.Destroy()
+	return nil
+}
+
+// Flags of the wrap tokens, RFC 4121 section 4.2.2.
+const (
+	wrapSentByAcceptor = 0x01
+	wrapSealed         = 0x02
+	wrapAcceptorSubkey = 0x04
+)
+
+// krb5Context is a GSSContext of the Kerberos V5 mechanism, established
+// with one AP-REQ and the AP-REP of the server.
+type krb5Context struct {
+	cl  *client.Client
+	spn string
+
+	sent       bool
+	auth       types.Authenticator
+	sessionKey types.EncryptionKey
+
+	// 上下文建立后保护报文的密钥，服务端给出子密钥时使用之
+	key   types.EncryptionKey
+	et    etype.EType
+	flags byte
+	seq   uint64
+}
+
+// cfxEtype reports whether the tokens of RFC 4121 apply to the encryption
+// type; the older types use the tokens of RFC 1964, which are not
+// implemented.
+func cfxEtype(id int32) bool {
+	return id != etypeID.DES3_CBC_SHA1_KD && id != etypeID.RC4_HMAC
+}
+
+func (c *krb5Context) InitSecContext(token []byte) ([]byte, bool, error) {
+	if !c.sent {
+		out, err := c.apReq()
+		c.sent = err == nil
+		return out, false, err
+	}
+	if err := c.apRep(token); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// apReq returns the initial token, the AP-REQ of RFC 4121 section 4.1.
+func (c *krb5Context) apReq() ([]byte, error) {
+	tkt, key, err := c.cl.GetServiceTicket(c.spn)
+	if err != nil {
+		return nil, err
+	}
+	if !cfxEtype(key.KeyType) {
+		return nil, fmt.Errorf("encryption type %d of the ticket for %s is not supported", key.KeyType, c.spn)
+	}
+	et, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := types.NewAuthenticator(c.cl.Credentials.Domain(), c.cl.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.GenerateSeqNumberAndSubKey(key.KeyType, et.GetKeyByteSize()); err != nil {
+		return nil, err
+	}
+	// 校验和：无通道绑定，请求双向认证、完整性与机密性
+	cksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(cksum, 16)
+	binary.LittleEndian.PutUint32(cksum[20:], gssapi.ContextFlagMutual|gssapi.ContextFlagConf|gssapi.ContextFlagInteg)
+	auth.Cksum = types.Checksum{CksumType: chksumtype.GSSAPI, Checksum: cksum}
+
+	req, err := messages.NewAPReq(tkt, key, auth)
+	if err != nil {
+		return nil, err
+	}
+	types.SetFlag(&req.APOptions, flags.APOptionMutualRequired)
+	b, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	c.auth, c.sessionKey = auth, key
+
+	tok, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	tok = append(tok, 0x01, 0x00)
+	tok = append(tok, b...)
+	return asn1tools.AddASNAppTag(tok, 0), nil
+}
+
+// apRep checks the AP-REP of the server, which authenticates it, and keeps
+// the key and sequence number of the context.
+func (c *krb5Context) apRep(token []byte) error {
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.UnmarshalWithParams(token, &oid, "application,explicit,tag:0")
+	if err != nil {
+		return err
+	}
+	if !oid.Equal(gssapi.OIDKRB5.OID()) || len(rest) < 2 {
+		return errors.New("invalid Kerberos token")
+	}
+	switch {
+	case rest[0] == 0x03 && rest[1] == 0x00:
+		var krbErr messages.KRBError
+		if err := krbErr.Unmarshal(rest[2:]); err != nil {
+			return err
+		}
+		return krbErr
+	case rest[0] != 0x02 || rest[1] != 0x00:
+		return fmt.Errorf("unexpected Kerberos token %#x", rest[:2])
+	}
+
+	var rep messages.APRep
+	if err := rep.Unmarshal(rest[2:]); err != nil {
+		return err
+	}
+	b, err := crypto.DecryptEncPart(rep.EncPart, c.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return err
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(b); err != nil {
+		return err
+	}
+	if part.CTime.Unix() != c.auth.CTime.Unix() || part.Cusec != c.auth.Cusec {
+		return errors.New("AP-REP does not match the authenticator")
+	}
+
+	key, wflags := c.auth.SubKey, byte(0)
+	if len(part.Subkey.KeyValue) > 0 {
+		key, wflags = part.Subkey, wrapAcceptorSubkey
+	}
+	if !cfxEtype(key.KeyType) {
+		return fmt.Errorf("encryption type %d of the subkey is not supported", key.KeyType)
+	}
+	et, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return err
+	}
+	c.key, c.et, c.flags = key, et, wflags
+	c.seq = uint64(c.auth.SeqNumber)
+	return nil
+}
+
+// wrapHeader returns the header of a wrap token, with EC and RRC zero.
+func wrapHeader(flags byte, seq uint64) []byte {
+	header := make([]byte, gssapi.HdrLen)
+	copy(header, []byte{0x05, 0x04, flags, gssapi.FillerByte})
+	binary.BigEndian.PutUint64(header[8:], seq)
+	return header
+}
+
+// Wrap returns the wrap token of p, RFC 4121 section 4.2.6.2.
+func (c *krb5Context) Wrap(p []byte, confidential bool) ([]byte, error) {
+	seq := c.seq
+	c.seq++
+
+	if !confidential {
+		wt := gssapi.WrapToken{
+			Flags:     c.flags,
+			EC:        uint16(c.et.GetHMACBitLength() / 8),
+			SndSeqNum: seq,
+			Payload:   append([]byte{}, p...),
+		}
+		if err := wt.SetCheckSum(c.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+			return nil, err
+		}
+		return wt.Marshal()
+	}
+
+	// 加密明文与头部副本，无填充
+	header := wrapHeader(c.flags|wrapSealed, seq)
+	plain := make([]byte, 0, len(p)+len(header))
+	plain = append(append(plain, p...), header...)
+	_, ct, err := c.et.EncryptMessage(c.key.KeyValue, plain, keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, ct...), nil
+}
+
+// Unwrap checks the wrap token p of the server and returns its message.
+func (c *krb5Context) Unwrap(p []byte) ([]byte, error) {
+	if len(p) < gssapi.HdrLen || p[0] != 0x05 || p[1] != 0x04 || p[3] != gssapi.FillerByte {
+		return nil, errors.New("invalid wrap token")
+	}
+	wflags := p[2]
+	if wflags&wrapSentByAcceptor == 0 {
+		return nil, errors.New("wrap token not sent by the server")
+	}
+	ec := int(binary.BigEndian.Uint16(p[4:]))
+	rrc := int(binary.BigEndian.Uint16(p[6:]))
+	seq := binary.BigEndian.Uint64(p[8:])
+
+	// 令牌数据可能右旋了 RRC 个字节
+	data := p[gssapi.HdrLen:]
+	if n := len(data); n > 0 && rrc%n != 0 {
+		r := rrc % n
+		data = append(append(make([]byte, 0, n), data[r:]...), data[:r]...)
+	}
+
+	if wflags&wrapSealed == 0 {
+		if ec > len(data) {
+			return nil, errors.New("invalid wrap token")
+		}
+		wt := gssapi.WrapToken{
+			Flags:     wflags,
+			EC:        uint16(ec),
+			SndSeqNum: seq,
+			Payload:   data[:len(data)-ec],
+			CheckSum:  data[len(data)-ec:],
+		}
+		if _, err := wt.Verify(c.key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+			return nil, err
+		}
+		return wt.Payload, nil
+	}
+
+	if len(data) < c.et.GetConfounderByteSize()+c.et.GetHMACBitLength()/8+gssapi.HdrLen {
+		return nil, errors.New("invalid wrap token")
+	}
+	plain, err := crypto.DecryptMessage(data, c.key, keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < ec+gssapi.HdrLen {
+		return nil, errors.New("invalid wrap token")
+	}
+	// 加密的头部副本除 RRC 外须与头部一致
+	copyHeader := plain[len(plain)-gssapi.HdrLen:]
+	if !bytes.Equal(copyHeader[:6], p[:6]) || !bytes.Equal(copyHeader[8:], p[8:gssapi.HdrLen]) {
+		return nil, errors.New("wrap token header was modified")
+	}
+	return plain[:len(plain)-gssapi.HdrLen-ec], nil
+}
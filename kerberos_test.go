@@ -0,0 +1,602 @@
+package gohbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const testRealm = "EXAMPLE.COM"
+
+// newTestKeytab returns a keytab of the principals of the tests: the
+// clients alice and bob, the KDC and the thrift server thrift1.
+func newTestKeytab(t *testing.T) *keytab.Keytab {
+	kt := keytab.New()
+	for _, p := range []string{"alice", "bob", "krbtgt/" + testRealm, "hbase/thrift1"} {
+		if err := kt.AddEntry(p, testRealm, p+"-secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kt
+}
+
+// newTestTicket returns a ticket of cname for sname, valid for an hour,
+// and its session key.
+func newTestTicket(t *testing.T, kt *keytab.Keytab, cname, sname types.PrincipalName) (messages.Ticket, types.EncryptionKey) {
+	now := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(cname, testRealm, sname, testRealm, types.NewKrbFlags(), kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now.Add(-time.Minute), now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tkt, key
+}
+
+// writeKrb5Conf writes a krb5.conf of testRealm, with its KDC at kdc if
+// set, and returns its path.
+func writeKrb5Conf(t *testing.T, kdc string) string {
+	conf := "[libdefaults]\n default_realm = " + testRealm + "\n udp_preference_limit = 1\n"
+	if kdc != "" {
+		conf += "[realms]\n " + testRealm + " = {\n  kdc = " + kdc + "\n }\n"
+	}
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeKDC answers the AS and TGS exchanges over TCP, with the keys of kt.
+type fakeKDC struct {
+	t  *testing.T
+	kt *keytab.Keytab
+
+	mu     sync.Mutex
+	tgtKey types.EncryptionKey
+	issued []string // 签发过服务票据的服务主体
+}
+
+// newFakeKDC starts a fakeKDC on a local port and returns its address.
+func newFakeKDC(t *testing.T, kt *keytab.Keytab) (*fakeKDC, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	kdc := &fakeKDC{t: t, kt: kt}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go kdc.serve(conn)
+		}
+	}()
+	return kdc, ln.Addr().String()
+}
+
+func (k *fakeKDC) serve(conn net.Conn) {
+	defer conn.Close()
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	req := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	var rep []byte
+	var err error
+	switch req[0] & 0x1f {
+	case asnAppTag.ASREQ:
+		rep, err = k.as(req)
+	case asnAppTag.TGSREQ:
+		rep, err = k.tgs(req)
+	default:
+		err = fmt.Errorf("unexpected KDC request %#x", req[0])
+	}
+	if err != nil {
+		k.t.Errorf("KDC: %v", err)
+		return
+	}
+	binary.BigEndian.PutUint32(header[:], uint32(len(rep)))
+	_, _ = conn.Write(append(header[:], rep...))
+}
+
+// encPart returns the encrypted part of a reply to body, for tkt.
+func encPart(body messages.KDCReqBody, tkt messages.Ticket, key types.EncryptionKey, usage uint32, encKey types.EncryptionKey, kvno int) (types.EncryptedData, error) {
+	now := time.Now().UTC()
+	part := messages.EncKDCRepPart{
+		Key:       key,
+		LastReqs:  []messages.LastReq{{LRValue: now}},
+		Nonce:     body.Nonce,
+		Flags:     types.NewKrbFlags(),
+		AuthTime:  now,
+		StartTime: now.Add(-time.Minute),
+		EndTime:   now.Add(time.Hour),
+		RenewTill: now.Add(time.Hour),
+		SRealm:    tkt.Realm,
+		SName:     tkt.SName,
+	}
+	b, err := part.Marshal()
+	if err != nil {
+		return types.EncryptedData{}, err
+	}
+	return crypto.GetEncryptedData(b, encKey, usage, kvno)
+}
+
+func (k *fakeKDC) as(b []byte) ([]byte, error) {
+	var req messages.ASReq
+	if err := req.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	clientKey, kvno, err := k.kt.GetEncryptionKey(req.ReqBody.CName, req.ReqBody.Realm, 0, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		krbErr := messages.NewKRBError(req.ReqBody.SName, req.ReqBody.Realm, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, err.Error())
+		return krbErr.Marshal()
+	}
+	tgt, key := newTestTicket(k.t, k.kt, req.ReqBody.CName, req.ReqBody.SName)
+	ed, err := encPart(req.ReqBody, tgt, key, keyusage.AS_REP_ENCPART, clientKey, kvno)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.tgtKey = key
+	k.mu.Unlock()
+
+	rep := messages.ASRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AS_REP,
+		CRealm:  req.ReqBody.Realm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tgt,
+		EncPart: ed,
+	}}
+	return rep.Marshal()
+}
+
+func (k *fakeKDC) tgs(b []byte) ([]byte, error) {
+	var req messages.TGSReq
+	if err := req.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	tkt, key := newTestTicket(k.t, k.kt, req.ReqBody.CName, req.ReqBody.SName)
+	k.mu.Lock()
+	tgtKey := k.tgtKey
+	k.issued = append(k.issued, req.ReqBody.SName.PrincipalNameString())
+	k.mu.Unlock()
+	ed, err := encPart(req.ReqBody, tkt, key, keyusage.TGS_REP_ENCPART_SESSION_KEY, tgtKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_TGS_REP,
+		CRealm:  req.ReqBody.Realm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: ed,
+	}}
+	return rep.Marshal()
+}
+
+func (k *fakeKDC) serviceTickets() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.issued...)
+}
+
+// writeCCache writes a credential cache, of version 4, of cname with a TGT
+// and a ticket for hbase/thrift1.
+func writeCCache(t *testing.T, path string, kt *keytab.Keytab, cname string) {
+	var buf bytes.Buffer
+	put := func(v interface{}) { _ = binary.Write(&buf, binary.BigEndian, v) }
+	putData := func(b []byte) {
+		put(uint32(len(b)))
+		buf.Write(b)
+	}
+	putPrincipal := func(pn types.PrincipalName) {
+		put(pn.NameType)
+		put(uint32(len(pn.NameString)))
+		putData([]byte(testRealm))
+		for _, s := range pn.NameString {
+			putData([]byte(s))
+		}
+	}
+
+	client := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, cname)
+	put(uint16(0x0504))
+	put(uint16(0)) // 无头部字段
+	putPrincipal(client)
+	for _, server := range []types.PrincipalName{
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm),
+		types.NewPrincipalName(nametype.KRB_NT_SRV_HST, "hbase/thrift1"),
+	} {
+		tkt, key := newTestTicket(t, kt, client, server)
+		b, err := tkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		putPrincipal(client)
+		putPrincipal(server)
+		put(uint16(key.KeyType))
+		putData(key.KeyValue)
+		for _, ts := range []time.Time{now, now.Add(-time.Minute), now.Add(time.Hour), now.Add(time.Hour)} {
+			put(uint32(ts.Unix()))
+		}
+		put(uint8(0))  // is_skey
+		put(uint32(0)) // 票据标志
+		put(uint32(0)) // 地址
+		put(uint32(0)) // 授权数据
+		putData(b)     // 票据
+		putData(nil)   // 第二票据
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// krb5Acceptor is the server side of a Kerberos security context, for the
+// service principal hbase/thrift1 of kt.
+type krb5Acceptor struct {
+	kt *keytab.Keytab
+
+	client string
+	key    types.EncryptionKey
+	seq    uint64
+}
+
+// accept checks the AP-REQ token of the client and returns the AP-REP,
+// with an acceptor subkey.
+func (a *krb5Acceptor) accept(token []byte) ([]byte, error) {
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.UnmarshalWithParams(token, &oid, "application,explicit,tag:0")
+	if err != nil {
+		return nil, err
+	}
+	if !oid.Equal(gssapi.OIDKRB5.OID()) || len(rest) < 2 || rest[0] != 0x01 || rest[1] != 0x00 {
+		return nil, errors.New("not an AP-REQ token")
+	}
+	var req messages.APReq
+	if err := req.Unmarshal(rest[2:]); err != nil {
+		return nil, err
+	}
+	ok, creds, err := service.VerifyAPREQ(&req, service.NewSettings(a.kt))
+	if !ok {
+		return nil, fmt.Errorf("AP-REQ not valid: %v", err)
+	}
+	a.client = creds.CName().PrincipalNameString()
+	if !types.IsFlagSet(&req.APOptions, flags.APOptionMutualRequired) {
+		return nil, errors.New("mutual authentication not requested")
+	}
+	if cksum := req.Authenticator.Cksum; cksum.CksumType != chksumtype.GSSAPI || len(cksum.Checksum) != 24 {
+		return nil, fmt.Errorf("authenticator checksum %+v", cksum)
+	}
+
+	et, err := crypto.GetEtype(req.Ticket.DecryptedEncPart.Key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	if a.key, err = types.GenerateEncryptionKey(et); err != nil {
+		return nil, err
+	}
+	a.seq = 1000
+	b, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          req.Authenticator.CTime,
+		Cusec:          req.Authenticator.Cusec,
+		Subkey:         a.key,
+		SequenceNumber: int64(a.seq),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ed, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart), req.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := asn1.Marshal(messages.APRep{PVNO: iana.PVNO, MsgType: msgtype.KRB_AP_REP, EncPart: ed})
+	if err != nil {
+		return nil, err
+	}
+	tok, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	tok = append(tok, 0x02, 0x00)
+	tok = append(tok, asn1tools.AddASNAppTag(rep, asnAppTag.APREP)...)
+	return asn1tools.AddASNAppTag(tok, 0), nil
+}
+
+// wrap returns a wrap token of p; sealed tokens are rotated by rrc bytes.
+func (a *krb5Acceptor) wrap(p []byte, sealed bool, rrc int) ([]byte, error) {
+	wflags := byte(wrapSentByAcceptor | wrapAcceptorSubkey)
+	seq := a.seq
+	a.seq++
+	if !sealed {
+		wt := gssapi.WrapToken{Flags: wflags, EC: 12, SndSeqNum: seq, Payload: p}
+		if err := wt.SetCheckSum(a.key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+			return nil, err
+		}
+		return wt.Marshal()
+	}
+
+	header := wrapHeader(wflags|wrapSealed, seq)
+	et, _ := crypto.GetEtype(a.key.KeyType)
+	_, ct, err := et.EncryptMessage(a.key.KeyValue, append(append([]byte{}, p...), header...), keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(header[6:], uint16(rrc))
+	rrc %= len(ct)
+	return append(append(header, ct[len(ct)-rrc:]...), ct[:len(ct)-rrc]...), nil
+}
+
+// unwrap checks a wrap token of the client and returns its message.
+func (a *krb5Acceptor) unwrap(tok []byte, sealed bool) ([]byte, error) {
+	if len(tok) < gssapi.HdrLen {
+		return nil, errors.New("short wrap token")
+	}
+	if want := byte(wrapAcceptorSubkey); sealed && tok[2] != want|wrapSealed || !sealed && tok[2] != want {
+		return nil, fmt.Errorf("wrap token flags %#x", tok[2])
+	}
+	if !sealed {
+		var wt gssapi.WrapToken
+		if err := wt.Unmarshal(tok, false); err != nil {
+			return nil, err
+		}
+		if _, err := wt.Verify(a.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+			return nil, err
+		}
+		return wt.Payload, nil
+	}
+	plain, err := crypto.DecryptMessage(tok[gssapi.HdrLen:], a.key, keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < gssapi.HdrLen || !bytes.Equal(plain[len(plain)-gssapi.HdrLen:], tok[:gssapi.HdrLen]) {
+		return nil, errors.New("wrap token header mismatch")
+	}
+	return plain[:len(plain)-gssapi.HdrLen], nil
+}
+
+// negotiateKerberos runs a GSSAPI negotiation of a client of newClient
+// with a, the server offering qop only, then exchanges a message each way.
+func negotiateKerberos(t *testing.T, newClient func(host string) (SASLClient, error), a *krb5Acceptor, qop QoP) error {
+	client, err := newClient("thrift1")
+	if err != nil {
+		return err
+	}
+	trans, srv := newTestSASL(t, client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fail := func(err error) {
+			t.Errorf("server: %v", err)
+			srv.send(saslError, []byte(err.Error()))
+		}
+		srv.receive()
+		_, tok := srv.receive()
+		rep, err := a.accept(tok)
+		if err != nil {
+			fail(err)
+			return
+		}
+		srv.send(saslOK, rep)
+		if _, tok = srv.receive(); len(tok) != 0 {
+			fail(fmt.Errorf("token after AP-REP %x", tok))
+			return
+		}
+		offer, _ := a.wrap([]byte{byte(qop), 0x10, 0, 0}, false, 0)
+		srv.send(saslOK, offer)
+		_, tok = srv.receive()
+		resp, err := a.unwrap(tok, false)
+		if err != nil || len(resp) < 4 || QoP(resp[0]) != qop {
+			fail(fmt.Errorf("layer response %v, %v", resp, err))
+			return
+		}
+		srv.send(saslComplete, nil)
+
+		frame := srv.readFrame()
+		if qop != QoPAuth {
+			if frame, err = a.unwrap(frame, qop == QoPAuthConf); err != nil {
+				t.Errorf("server unwrap: %v", err)
+			}
+		}
+		if string(frame) != "ping" {
+			t.Errorf("frame = %q", frame)
+		}
+		reply := []byte("pong")
+		if qop != QoPAuth {
+			reply, _ = a.wrap(reply, qop == QoPAuthConf, 28)
+		}
+		srv.writeFrame(reply)
+	}()
+	defer func() { <-done }()
+
+	if err := trans.negotiate(); err != nil {
+		return err
+	}
+	_, _ = trans.Write([]byte("ping"))
+	if err := trans.Flush(); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(trans, buf); err != nil {
+		return err
+	}
+	if string(buf) != "pong" {
+		return fmt.Errorf("read %q", buf)
+	}
+	return nil
+}
+
+func TestKerberosKeytab(t *testing.T) {
+	kt := newTestKeytab(t)
+	kdc, addr := newFakeKDC(t, kt)
+	ktFile := filepath.Join(t.TempDir(), "client.keytab")
+	f, err := os.Create(ktFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kt.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	krb, err := NewKeytabKerberos(writeKrb5Conf(t, addr), ktFile, "alice@"+testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer krb.Close()
+
+	for _, qop := range []QoP{QoPAuth, QoPAuthInt, QoPAuthConf} {
+		qop := qop
+		t.Run(qop.String(), func(t *testing.T) {
+			a := &krb5Acceptor{kt: kt}
+			if err := negotiateKerberos(t, NewGSSAPISASL("hbase", "", krb.NewGSSContext), a, qop); err != nil {
+				t.Fatal(err)
+			}
+			if a.client != "alice" {
+				t.Errorf("authenticated as %q, want alice", a.client)
+			}
+		})
+	}
+	// 服务票据只向 KDC 请求一次
+	if tgs := kdc.serviceTickets(); len(tgs) != 1 || tgs[0] != "hbase/thrift1" {
+		t.Errorf("service tickets requested: %v", tgs)
+	}
+
+	if _, err := NewKeytabKerberos(writeKrb5Conf(t, addr), ktFile, "carol"); err == nil {
+		t.Error("login of a principal missing from the keytab succeeded")
+	}
+}
+
+func TestKerberosCCache(t *testing.T) {
+	kt := newTestKeytab(t)
+	ccache := filepath.Join(t.TempDir(), "krb5cc")
+	writeCCache(t, ccache, kt, "alice")
+
+	// 票据均在缓存中，无需 KDC
+	krb, err := NewCCacheKerberos(writeKrb5Conf(t, ""), ccache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer krb.Close()
+
+	a := &krb5Acceptor{kt: kt}
+	if err := negotiateKerberos(t, NewGSSAPISASL("hbase", "", krb.NewGSSContext), a, QoPAuthConf); err != nil {
+		t.Fatal(err)
+	}
+	if a.client != "alice" {
+		t.Errorf("authenticated as %q, want alice", a.client)
+	}
+
+	// kinit 改写缓存后，新连接使用新的登录
+	writeCCache(t, ccache, kt, "bob")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(ccache, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := negotiateKerberos(t, NewGSSAPISASL("hbase", "", krb.NewGSSContext), a, QoPAuthInt); err != nil {
+		t.Fatal(err)
+	}
+	if a.client != "bob" {
+		t.Errorf("authenticated as %q after kinit, want bob", a.client)
+	}
+
+	// 缓存损坏时保留之前的登录
+	if err := os.WriteFile(ccache, []byte{5, 4}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(ccache, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := negotiateKerberos(t, NewGSSAPISASL("hbase", "", krb.NewGSSContext), a, QoPAuth); err != nil {
+		t.Fatal(err)
+	}
+	if a.client != "bob" {
+		t.Errorf("authenticated as %q with a broken cache, want bob", a.client)
+	}
+}
+
+func TestKerberosUnwrap(t *testing.T) {
+	kt := newTestKeytab(t)
+	ccache := filepath.Join(t.TempDir(), "krb5cc")
+	writeCCache(t, ccache, kt, "alice")
+	krb, err := NewCCacheKerberos(writeKrb5Conf(t, ""), ccache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer krb.Close()
+
+	gss, _ := krb.NewGSSContext("hbase", "thrift1")
+	a := &krb5Acceptor{kt: kt}
+	tok, _, err := gss.InitSecContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := a.accept(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, done, err := gss.InitSecContext(rep); !done || err != nil {
+		t.Fatalf("context not established: %v", err)
+	}
+
+	for _, sealed := range []bool{false, true} {
+		for _, rrc := range []int{0, 5, 28} {
+			tok, err := a.wrap([]byte("message"), sealed, rrc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sealed && bytes.Contains(tok, []byte("message")) {
+				t.Error("sealed token contains the message in clear")
+			}
+			if !sealed && rrc != 0 {
+				continue
+			}
+			if p, err := gss.Unwrap(tok); err != nil || string(p) != "message" {
+				t.Errorf("Unwrap(sealed %v, rrc %d) = %q, %v", sealed, rrc, p, err)
+			}
+
+			tok[len(tok)-1] ^= 1
+			if _, err := gss.Unwrap(tok); err == nil {
+				t.Errorf("Unwrap(sealed %v, rrc %d) of a modified token succeeded", sealed, rrc)
+			}
+		}
+	}
+
+	// 客户端自己的令牌不被接受
+	tok, _ = gss.Wrap([]byte("message"), false)
+	if _, err := gss.Unwrap(tok); err == nil {
+		t.Error("Unwrap of a token of the client succeeded")
+	}
+}
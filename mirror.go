@@ -0,0 +1,577 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// ErrMirrorBacklog is reported to MirrorOptions.OnSecondaryError when a
+// write or shadow read is dropped because MaxPending calls are pending on
+// the secondary.
+var ErrMirrorBacklog = errors.New("HBase: mirror backlog is full")
+
+// MirrorMode is the way a mirroring client acknowledges writes.
+type MirrorMode int
+
+const (
+	// MirrorPrimaryAck returns once the primary applied a write. The write
+	// is applied to the secondary in the background, with the arguments of
+	// the call: the caller must not modify them, e.g. reuse a TPut, after
+	// the call.
+	MirrorPrimaryAck MirrorMode = iota
+	// MirrorBothAck returns once both the primary and the secondary applied
+	// a write. A failure of the secondary is reported, not returned.
+	MirrorBothAck
+)
+
+// MirrorOptions configures a mirroring client.
+type MirrorOptions struct {
+	// Mode is the way writes are acknowledged.
+	// Default is MirrorPrimaryAck.
+	Mode MirrorMode
+	// Ratio, between 0 and 1, of the reads, i.e. Exists, Get, GetMultiple
+	// and GetScannerResults, also sent to the secondary in the background
+	// and compared with the answer of the primary.
+	// Default is 0, which disables shadow reads.
+	ShadowReads float64
+	// Number of goroutines applying writes to the secondary in
+	// MirrorPrimaryAck mode. Single-row writes to a row are applied in
+	// order; DeleteMultiple and PutMultiple may be applied before or after
+	// those to their rows.
+	// Default is 4.
+	Workers int
+	// Maximum number of writes and shadow reads pending on the secondary.
+	// Further ones are dropped and reported with ErrMirrorBacklog.
+	// Default is 1000.
+	MaxPending int
+	// Timeout of the calls made on the secondary in the background.
+	// Default is 5 seconds.
+	SecondaryTimeout time.Duration
+	// Function called when the secondary fails a call that succeeded on
+	// the primary. op is the thrift method name, e.g. "put". It must not
+	// block.
+	OnSecondaryError func(op string, table []byte, err error)
+	// Function called when the secondary answers a call differently than
+	// the primary. It must not block.
+	OnDivergence func(op string, table []byte, primary, secondary interface{})
+}
+
+func (opt *MirrorOptions) init() {
+	if opt.Workers <= 0 {
+		opt.Workers = 4
+	}
+	if opt.MaxPending <= 0 {
+		opt.MaxPending = 1000
+	}
+	if opt.SecondaryTimeout == 0 {
+		opt.SecondaryTimeout = 5 * time.Second
+	}
+}
+
+// mirrorCall runs a call on one of the clients of a mirror.
+type mirrorCall func(ctx context.Context, hb HBase) (interface{}, error)
+
+type mirrorTask struct {
+	op    string
+	table []byte
+	v     interface{} // 主集群的结果
+	user  string      // doAs 用户，在次集群上沿用
+	call  mirrorCall
+	same  func(a, b interface{}) bool
+}
+
+// mirror is an HBase that mirrors the calls made on a primary client to a
+// secondary one.
+type mirror struct {
+	primary   HBase
+	secondary HBase
+	opt       *MirrorOptions
+
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan *mirrorTask
+	wg      sync.WaitGroup
+	pending int32 // atomic
+}
+
+// NewMirror returns an HBase client mirroring primary to secondary, e.g.
+// during a migration. Writes go to both clients, as set by opt.Mode. Reads
+// are answered by the primary, and may be compared with the secondary.
+// Scanners and region locations are served by the primary only. Failures
+// of the secondary never fail a call; they are reported to
+// opt.OnSecondaryError instead. Closing the mirror waits for the pending
+// writes, then closes both clients.
+func NewMirror(primary, secondary HBase, opt *MirrorOptions) HBase {
+	o := MirrorOptions{}
+	if opt != nil {
+		o = *opt
+	}
+	opt = &o
+	opt.init()
+
+	m := &mirror{
+		primary:   primary,
+		secondary: secondary,
+		opt:       opt,
+	}
+	if opt.Mode == MirrorPrimaryAck {
+		m.queues = make([]chan *mirrorTask, opt.Workers)
+		for i := range m.queues {
+			m.queues[i] = make(chan *mirrorTask, opt.MaxPending/opt.Workers+1)
+			m.wg.Add(1)
+			go m.worker(m.queues[i])
+		}
+	}
+	return m
+}
+
+func (m *mirror) worker(queue chan *mirrorTask) {
+	defer m.wg.Done()
+	for t := range queue {
+		ctx, cancel := context.WithTimeout(context.Background(), m.opt.SecondaryTimeout)
+		m.mirror(ctx, t)
+		cancel()
+		atomic.AddInt32(&m.pending, -1)
+	}
+}
+
+// mirror runs t on the secondary and reports the outcome.
+func (m *mirror) mirror(ctx context.Context, t *mirrorTask) {
+	if t.user != "" {
+		ctx = WithUser(ctx, t.user)
+	}
+	v, err := t.call(ctx, m.secondary)
+	if err != nil {
+		m.secondaryError(t.op, t.table, err)
+		return
+	}
+	if t.same != nil && !t.same(t.v, v) && m.opt.OnDivergence != nil {
+		m.opt.OnDivergence(t.op, t.table, t.v, v)
+	}
+}
+
+func (m *mirror) secondaryError(op string, table []byte, err error) {
+	if m.opt.OnSecondaryError != nil {
+		m.opt.OnSecondaryError(op, table, err)
+	}
+}
+
+// acquire takes a pending slot, or reports t as dropped.
+func (m *mirror) acquire(t *mirrorTask) bool {
+	if atomic.AddInt32(&m.pending, 1) > int32(m.opt.MaxPending) {
+		atomic.AddInt32(&m.pending, -1)
+		m.secondaryError(t.op, t.table, ErrMirrorBacklog)
+		return false
+	}
+	return true
+}
+
+// write runs call on the primary and, if it succeeded, on the secondary.
+// Writes to row go through the same worker so that they keep their order;
+// batches pass the row of their first write only.
+func (m *mirror) write(ctx context.Context, op string, table, row []byte, same func(a, b interface{}) bool, call mirrorCall) (interface{}, error) {
+	v, err := call(ctx, m.primary)
+	if err != nil {
+		return v, err
+	}
+
+	t := &mirrorTask{op: op, table: table, v: v, user: doAsUser(ctx), call: call, same: same}
+	if m.opt.Mode == MirrorBothAck {
+		m.mirror(ctx, t)
+		return v, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed || !m.acquire(t) {
+		return v, nil
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(table)
+	_, _ = h.Write(row)
+	select {
+	case m.queues[h.Sum32()%uint32(len(m.queues))] <- t:
+	default:
+		atomic.AddInt32(&m.pending, -1)
+		m.secondaryError(op, table, ErrMirrorBacklog)
+	}
+	return v, nil
+}
+
+// read runs call on the primary and, for a ShadowReads share of the calls,
+// compares its answer with the one of the secondary in the background.
+func (m *mirror) read(ctx context.Context, op string, table []byte, same func(a, b interface{}) bool, call mirrorCall) (interface{}, error) {
+	v, err := call(ctx, m.primary)
+	if err != nil || m.opt.ShadowReads <= 0 || rand.Float64() >= m.opt.ShadowReads {
+		return v, err
+	}
+
+	t := &mirrorTask{op: op, table: table, v: v, user: doAsUser(ctx), call: call, same: same}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed || !m.acquire(t) {
+		return v, nil
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), m.opt.SecondaryTimeout)
+		m.mirror(ctx, t)
+		cancel()
+		atomic.AddInt32(&m.pending, -1)
+	}()
+	return v, nil
+}
+
+func sameBool(a, b interface{}) bool {
+	return a.(bool) == b.(bool)
+}
+
+func sameResult(a, b interface{}) bool {
+	return equalResult(a.(*hbase.TResult_), b.(*hbase.TResult_))
+}
+
+func sameResults(a, b interface{}) bool {
+	ra, rb := a.([]*hbase.TResult_), b.([]*hbase.TResult_)
+	if len(ra) != len(rb) {
+		return false
+	}
+	for i := range ra {
+		if !equalResult(ra[i], rb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalResult compares the rows and cells of two results. Timestamps are
+// ignored, as each cluster assigns its own.
+func equalResult(a, b *hbase.TResult_) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !bytes.Equal(a.Row, b.Row) || len(a.ColumnValues) != len(b.ColumnValues) {
+		return false
+	}
+	for i, ca := range a.ColumnValues {
+		cb := b.ColumnValues[i]
+		if !bytes.Equal(ca.Family, cb.Family) || !bytes.Equal(ca.Qualifier, cb.Qualifier) || !bytes.Equal(ca.Value, cb.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Append implements HBase
+func (m *mirror) Append(table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	return m.AppendContext(context.Background(), table, tappend)
+}
+
+// AppendContext implements HBase
+func (m *mirror) AppendContext(ctx context.Context, table []byte, tappend *hbase.TAppend) (r *hbase.TResult_, err error) {
+	if tappend == nil {
+		return nil, nilArgument("tappend")
+	}
+	v, err := m.write(ctx, "append", table, tappend.Row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.AppendContext(ctx, table, tappend)
+	})
+	r, _ = v.(*hbase.TResult_)
+	return
+}
+
+// CheckAndDelete implements HBase
+func (m *mirror) CheckAndDelete(table []byte, row []byte, family []byte, qualifier []byte, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
+	return m.CheckAndDeleteContext(context.Background(), table, row, family, qualifier, value, tdelete)
+}
+
+// CheckAndDeleteContext implements HBase
+func (m *mirror) CheckAndDeleteContext(ctx context.Context, table []byte, row []byte, family []byte, qualifier []byte, value []byte, tdelete *hbase.TDelete) (r bool, err error) {
+	v, err := m.write(ctx, "checkAndDelete", table, row, sameBool, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.CheckAndDeleteContext(ctx, table, row, family, qualifier, value, tdelete)
+	})
+	r, _ = v.(bool)
+	return
+}
+
+// CheckAndPut implements HBase
+func (m *mirror) CheckAndPut(table []byte, row []byte, family []byte, qualifier []byte, value []byte, tput *hbase.TPut) (r bool, err error) {
+	return m.CheckAndPutContext(context.Background(), table, row, family, qualifier, value, tput)
+}
+
+// CheckAndPutContext implements HBase
+func (m *mirror) CheckAndPutContext(ctx context.Context, table []byte, row []byte, family []byte, qualifier []byte, value []byte, tput *hbase.TPut) (r bool, err error) {
+	v, err := m.write(ctx, "checkAndPut", table, row, sameBool, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.CheckAndPutContext(ctx, table, row, family, qualifier, value, tput)
+	})
+	r, _ = v.(bool)
+	return
+}
+
+// CloseScanner implements HBase
+func (m *mirror) CloseScanner(scannerId int32) (err error) {
+	return m.primary.CloseScanner(scannerId)
+}
+
+// CloseScannerContext implements HBase
+func (m *mirror) CloseScannerContext(ctx context.Context, scannerId int32) (err error) {
+	return m.primary.CloseScannerContext(ctx, scannerId)
+}
+
+// DeleteMultiple implements HBase
+func (m *mirror) DeleteMultiple(table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
+	return m.DeleteMultipleContext(context.Background(), table, tdeletes)
+}
+
+// DeleteMultipleContext implements HBase
+func (m *mirror) DeleteMultipleContext(ctx context.Context, table []byte, tdeletes []*hbase.TDelete) (r []*hbase.TDelete, err error) {
+	var row []byte
+	if len(tdeletes) > 0 && tdeletes[0] != nil {
+		row = tdeletes[0].Row
+	}
+	v, err := m.write(ctx, "deleteMultiple", table, row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.DeleteMultipleContext(ctx, table, tdeletes)
+	})
+	r, _ = v.([]*hbase.TDelete)
+	return
+}
+
+// DeleteSingle implements HBase
+func (m *mirror) DeleteSingle(table []byte, tdelete *hbase.TDelete) (err error) {
+	return m.DeleteSingleContext(context.Background(), table, tdelete)
+}
+
+// DeleteSingleContext implements HBase
+func (m *mirror) DeleteSingleContext(ctx context.Context, table []byte, tdelete *hbase.TDelete) (err error) {
+	if tdelete == nil {
+		return nilArgument("tdelete")
+	}
+	_, err = m.write(ctx, "deleteSingle", table, tdelete.Row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return nil, hb.DeleteSingleContext(ctx, table, tdelete)
+	})
+	return
+}
+
+// Exists implements HBase
+func (m *mirror) Exists(table []byte, tget *hbase.TGet) (r bool, err error) {
+	return m.ExistsContext(context.Background(), table, tget)
+}
+
+// ExistsContext implements HBase
+func (m *mirror) ExistsContext(ctx context.Context, table []byte, tget *hbase.TGet) (r bool, err error) {
+	v, err := m.read(ctx, "exists", table, sameBool, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.ExistsContext(ctx, table, tget)
+	})
+	r, _ = v.(bool)
+	return
+}
+
+// Get implements HBase
+func (m *mirror) Get(table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
+	return m.GetContext(context.Background(), table, tget)
+}
+
+// GetContext implements HBase
+func (m *mirror) GetContext(ctx context.Context, table []byte, tget *hbase.TGet) (r *hbase.TResult_, err error) {
+	v, err := m.read(ctx, "get", table, sameResult, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.GetContext(ctx, table, tget)
+	})
+	r, _ = v.(*hbase.TResult_)
+	return
+}
+
+// GetAllRegionLocations implements HBase
+func (m *mirror) GetAllRegionLocations(table []byte) (r []*hbase.THRegionLocation, err error) {
+	return m.primary.GetAllRegionLocations(table)
+}
+
+// GetAllRegionLocationsContext implements HBase
+func (m *mirror) GetAllRegionLocationsContext(ctx context.Context, table []byte) (r []*hbase.THRegionLocation, err error) {
+	return m.primary.GetAllRegionLocationsContext(ctx, table)
+}
+
+// GetMultiple implements HBase
+func (m *mirror) GetMultiple(table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
+	return m.GetMultipleContext(context.Background(), table, tgets)
+}
+
+// GetMultipleContext implements HBase
+func (m *mirror) GetMultipleContext(ctx context.Context, table []byte, tgets []*hbase.TGet) (r []*hbase.TResult_, err error) {
+	v, err := m.read(ctx, "getMultiple", table, sameResults, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.GetMultipleContext(ctx, table, tgets)
+	})
+	r, _ = v.([]*hbase.TResult_)
+	return
+}
+
+// GetRegionLocation implements HBase
+func (m *mirror) GetRegionLocation(table []byte, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
+	return m.primary.GetRegionLocation(table, row, reload)
+}
+
+// GetRegionLocationContext implements HBase
+func (m *mirror) GetRegionLocationContext(ctx context.Context, table []byte, row []byte, reload bool) (r *hbase.THRegionLocation, err error) {
+	return m.primary.GetRegionLocationContext(ctx, table, row, reload)
+}
+
+// GetScannerResults implements HBase
+func (m *mirror) GetScannerResults(table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
+	return m.GetScannerResultsContext(context.Background(), table, tscan, numRows)
+}
+
+// GetScannerResultsContext implements HBase
+func (m *mirror) GetScannerResultsContext(ctx context.Context, table []byte, tscan *hbase.TScan, numRows int32) (r []*hbase.TResult_, err error) {
+	v, err := m.read(ctx, "getScannerResults", table, sameResults, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.GetScannerResultsContext(ctx, table, tscan, numRows)
+	})
+	r, _ = v.([]*hbase.TResult_)
+	return
+}
+
+// GetScannerRows implements HBase
+func (m *mirror) GetScannerRows(scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
+	return m.primary.GetScannerRows(scannerId, numRows)
+}
+
+// GetScannerRowsContext implements HBase
+func (m *mirror) GetScannerRowsContext(ctx context.Context, scannerId int32, numRows int32) (r []*hbase.TResult_, err error) {
+	return m.primary.GetScannerRowsContext(ctx, scannerId, numRows)
+}
+
+// Increment implements HBase
+func (m *mirror) Increment(table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
+	return m.IncrementContext(context.Background(), table, tincrement)
+}
+
+// IncrementContext implements HBase
+func (m *mirror) IncrementContext(ctx context.Context, table []byte, tincrement *hbase.TIncrement) (r *hbase.TResult_, err error) {
+	if tincrement == nil {
+		return nil, nilArgument("tincrement")
+	}
+	v, err := m.write(ctx, "increment", table, tincrement.Row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return hb.IncrementContext(ctx, table, tincrement)
+	})
+	r, _ = v.(*hbase.TResult_)
+	return
+}
+
+// MutateRow implements HBase
+func (m *mirror) MutateRow(table []byte, trowMutations *hbase.TRowMutations) (err error) {
+	return m.MutateRowContext(context.Background(), table, trowMutations)
+}
+
+// MutateRowContext implements HBase
+func (m *mirror) MutateRowContext(ctx context.Context, table []byte, trowMutations *hbase.TRowMutations) (err error) {
+	if trowMutations == nil {
+		return nilArgument("trowMutations")
+	}
+	_, err = m.write(ctx, "mutateRow", table, trowMutations.Row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return nil, hb.MutateRowContext(ctx, table, trowMutations)
+	})
+	return
+}
+
+// OpenScanner implements HBase
+func (m *mirror) OpenScanner(table []byte, tscan *hbase.TScan) (r int32, err error) {
+	return m.primary.OpenScanner(table, tscan)
+}
+
+// OpenScannerContext implements HBase
+func (m *mirror) OpenScannerContext(ctx context.Context, table []byte, tscan *hbase.TScan) (r int32, err error) {
+	return m.primary.OpenScannerContext(ctx, table, tscan)
+}
+
+// Put implements HBase
+func (m *mirror) Put(table []byte, tput *hbase.TPut) (err error) {
+	return m.PutContext(context.Background(), table, tput)
+}
+
+// PutContext implements HBase
+func (m *mirror) PutContext(ctx context.Context, table []byte, tput *hbase.TPut) (err error) {
+	if tput == nil {
+		return nilArgument("tput")
+	}
+	_, err = m.write(ctx, "put", table, tput.Row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return nil, hb.PutContext(ctx, table, tput)
+	})
+	return
+}
+
+// PutMultiple implements HBase
+func (m *mirror) PutMultiple(table []byte, tputs []*hbase.TPut) (err error) {
+	return m.PutMultipleContext(context.Background(), table, tputs)
+}
+
+// PutMultipleContext implements HBase
+func (m *mirror) PutMultipleContext(ctx context.Context, table []byte, tputs []*hbase.TPut) (err error) {
+	var row []byte
+	if len(tputs) > 0 && tputs[0] != nil {
+		row = tputs[0].Row
+	}
+	_, err = m.write(ctx, "putMultiple", table, row, nil, func(ctx context.Context, hb HBase) (interface{}, error) {
+		return nil, hb.PutMultipleContext(ctx, table, tputs)
+	})
+	return
+}
+
+// Scan implements HBase
+func (m *mirror) Scan(table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	return m.primary.Scan(table, tscan)
+}
+
+// ScanContext implements HBase
+func (m *mirror) ScanContext(ctx context.Context, table []byte, tscan *hbase.TScan) (*Scanner, error) {
+	return m.primary.ScanContext(ctx, table, tscan)
+}
+
+// PoolStats implements HBase, for the primary.
+func (m *mirror) PoolStats() *Stats {
+	return m.primary.PoolStats()
+}
+
+// EndpointStats implements HBase, for the primary.
+func (m *mirror) EndpointStats() map[string]*Stats {
+	return m.primary.EndpointStats()
+}
+
+// PoolState implements HBase, for the primary.
+func (m *mirror) PoolState() PoolState {
+	return m.primary.PoolState()
+}
+
+// As implements HBase. The calls of the returned client are made on behalf
+// of user on both clients.
+func (m *mirror) As(user string) HBase {
+	return newUserClient(m, user)
+}
+
+// Close waits for the pending writes and shadow reads, then closes both
+// clients.
+func (m *mirror) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	for _, queue := range m.queues {
+		close(queue)
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	err := m.primary.Close()
+	if serr := m.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,282 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// fakeClient is an HBase recording the Put, Increment and CheckAndPut calls
+// made on it, and answering Get and Exists with fixed values. Other methods
+// are not implemented.
+type fakeClient struct {
+	HBase
+	gate   chan struct{} // 非 nil 时，调用等待其关闭
+	err    error         // 所有调用返回的错误
+	value  string        // Get 返回的值
+	exists bool
+	jitter bool // 调用前随机等待，打乱并发调用的顺序
+
+	mu     sync.Mutex
+	calls  []string
+	closed bool
+}
+
+func (c *fakeClient) call(record string) error {
+	if c.gate != nil {
+		<-c.gate
+	}
+	if c.jitter {
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	}
+	c.mu.Lock()
+	c.calls = append(c.calls, record)
+	c.mu.Unlock()
+	return c.err
+}
+
+func (c *fakeClient) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+func (c *fakeClient) PutContext(ctx context.Context, table []byte, tput *hbase.TPut) error {
+	return c.call("put " + string(tput.Row) + "=" + string(tput.ColumnValues[0].Value))
+}
+
+func (c *fakeClient) IncrementContext(ctx context.Context, table []byte, tincrement *hbase.TIncrement) (*hbase.TResult_, error) {
+	return &hbase.TResult_{Row: tincrement.Row}, c.call("increment " + string(tincrement.Row))
+}
+
+func (c *fakeClient) CheckAndPutContext(ctx context.Context, table, row, family, qualifier, value []byte, tput *hbase.TPut) (bool, error) {
+	return c.exists, c.call("checkAndPut " + string(row))
+}
+
+func (c *fakeClient) GetContext(ctx context.Context, table []byte, tget *hbase.TGet) (*hbase.TResult_, error) {
+	r := &hbase.TResult_{Row: tget.Row, ColumnValues: []*hbase.TColumnValue{{Family: []byte("f"), Qualifier: []byte("q"), Value: []byte(c.value)}}}
+	return r, c.call("get " + string(tget.Row))
+}
+
+func (c *fakeClient) ExistsContext(ctx context.Context, table []byte, tget *hbase.TGet) (bool, error) {
+	return c.exists, c.call("exists " + string(tget.Row))
+}
+
+func (c *fakeClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+// newPut returns a put of value in row.
+func newPut(row, value string) *hbase.TPut {
+	return &hbase.TPut{Row: []byte(row), ColumnValues: []*hbase.TColumnValue{{Family: []byte("f"), Qualifier: []byte("q"), Value: []byte(value)}}}
+}
+
+// mirrorEvents records the calls of the mirror callbacks.
+type mirrorEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *mirrorEvents) add(event string) {
+	e.mu.Lock()
+	e.events = append(e.events, event)
+	e.mu.Unlock()
+}
+
+func (e *mirrorEvents) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func (e *mirrorEvents) options(opt *MirrorOptions) *MirrorOptions {
+	opt.OnSecondaryError = func(op string, table []byte, err error) {
+		e.add(fmt.Sprintf("error %s %s: %v", op, table, err))
+	}
+	opt.OnDivergence = func(op string, table []byte, primary, secondary interface{}) {
+		e.add(fmt.Sprintf("divergence %s %s", op, table))
+	}
+	return opt
+}
+
+func TestMirrorPrimaryAck(t *testing.T) {
+	primary := &fakeClient{}
+	secondary := &fakeClient{gate: make(chan struct{})}
+	m := NewMirror(primary, secondary, nil)
+
+	// 次集群阻塞时，写入在主集群完成后即返回
+	for i := 0; i < 3; i++ {
+		if err := m.Put([]byte("t"), newPut("row", fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(primary.recorded()); n != 3 {
+		t.Fatalf("primary got %d writes, want 3", n)
+	}
+
+	// Close 等待次集群上未完成的写入
+	closed := make(chan error, 1)
+	go func() { closed <- m.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the pending writes were applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(secondary.gate)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	want := "put row=0,put row=1,put row=2"
+	if got := strings.Join(secondary.recorded(), ","); got != want {
+		t.Errorf("secondary got %s, want %s", got, want)
+	}
+	if !primary.closed || !secondary.closed {
+		t.Error("Close did not close both clients")
+	}
+	if err := m.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestMirrorBothAck(t *testing.T) {
+	var events mirrorEvents
+	primary := &fakeClient{}
+	secondary := &fakeClient{}
+	m := NewMirror(primary, secondary, events.options(&MirrorOptions{Mode: MirrorBothAck}))
+	defer m.Close()
+
+	if err := m.Put([]byte("t"), newPut("a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	// 双写确认模式下，返回时次集群已完成写入
+	if got := strings.Join(secondary.recorded(), ","); got != "put a=1" {
+		t.Fatalf("secondary got %q on return, want the put", got)
+	}
+
+	// 次集群的失败只上报，不返回
+	secondary.err = errors.New("secondary down")
+	if _, err := m.Increment([]byte("t"), &hbase.TIncrement{Row: []byte("b")}); err != nil {
+		t.Fatalf("Increment failing on the secondary = %v, want nil", err)
+	}
+	// 主集群失败时不写次集群
+	primary.err = errors.New("primary down")
+	if err := m.Put([]byte("t"), newPut("c", "1")); err != primary.err {
+		t.Fatalf("Put failing on the primary = %v, want %v", err, primary.err)
+	}
+	if n := len(secondary.recorded()); n != 2 {
+		t.Errorf("secondary got %d writes, want 2", n)
+	}
+
+	// 条件写入的结果不同即为分歧
+	primary.err, secondary.err = nil, nil
+	primary.exists = true
+	if _, err := m.CheckAndPut([]byte("t"), []byte("d"), nil, nil, nil, newPut("d", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"error increment t: secondary down", "divergence checkAndPut t"}
+	if got := events.get(); strings.Join(got, ";") != strings.Join(want, ";") {
+		t.Errorf("callbacks got %q, want %q", got, want)
+	}
+}
+
+func TestMirrorRowOrder(t *testing.T) {
+	primary := &fakeClient{}
+	secondary := &fakeClient{jitter: true}
+	m := NewMirror(primary, secondary, &MirrorOptions{Workers: 4})
+
+	const rows, writes = 8, 50
+	var wg sync.WaitGroup
+	for r := 0; r < rows; r++ {
+		wg.Add(1)
+		go func(row string) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := m.Put([]byte("t"), newPut(row, fmt.Sprint(i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(fmt.Sprint("row", r))
+	}
+	wg.Wait()
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一行的写入按顺序到达次集群
+	next := map[string]int{}
+	calls := secondary.recorded()
+	for _, call := range calls {
+		kv := strings.SplitN(strings.TrimPrefix(call, "put "), "=", 2)
+		if want := fmt.Sprint(next[kv[0]]); kv[1] != want {
+			t.Fatalf("secondary got write %s of %s, want %s", kv[1], kv[0], want)
+		}
+		next[kv[0]]++
+	}
+	if len(calls) != rows*writes {
+		t.Errorf("secondary got %d writes, want %d", len(calls), rows*writes)
+	}
+}
+
+func TestMirrorBacklog(t *testing.T) {
+	var events mirrorEvents
+	secondary := &fakeClient{gate: make(chan struct{})}
+	m := NewMirror(&fakeClient{}, secondary, events.options(&MirrorOptions{Workers: 1, MaxPending: 2}))
+
+	for i := 0; i < 4; i++ {
+		if err := m.Put([]byte("t"), newPut("row", fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(secondary.gate)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := "error put t: " + ErrMirrorBacklog.Error()
+	if got := events.get(); strings.Join(got, ";") != dropped+";"+dropped {
+		t.Errorf("callbacks got %q, want two dropped writes", got)
+	}
+	if got := strings.Join(secondary.recorded(), ","); got != "put row=0,put row=1" {
+		t.Errorf("secondary got %s, want the first two writes", got)
+	}
+}
+
+func TestMirrorShadowReads(t *testing.T) {
+	var events mirrorEvents
+	primary := &fakeClient{value: "1", exists: true}
+	secondary := &fakeClient{value: "2", exists: true}
+	m := NewMirror(primary, secondary, events.options(&MirrorOptions{ShadowReads: 1}))
+
+	r, err := m.Get([]byte("t"), &hbase.TGet{Row: []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.ColumnValues[0].Value) != "1" {
+		t.Errorf("Get answered %q, want the value of the primary", r.ColumnValues[0].Value)
+	}
+	if _, err := m.Exists([]byte("t"), &hbase.TGet{Row: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有 Get 的结果不同
+	if got := events.get(); strings.Join(got, ";") != "divergence get t" {
+		t.Errorf("callbacks got %q, want a divergence of get", got)
+	}
+	if n := len(secondary.recorded()); n != 2 {
+		t.Errorf("secondary got %d shadow reads, want 2", n)
+	}
+}
@@ -2,6 +2,10 @@
 package gohbase
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
 	"runtime"
 	"time"
 )
@@ -9,19 +13,160 @@ import (
 type Options struct {
 	// host:port address.
 	Addr string
+	// host:port addresses of several thrift servers, each served by its own
+	// connection pool. Default is Addr alone.
+	Addrs []string
+	// Resolver supplies the addresses of the thrift servers, and their
+	// updates, in place of Addrs. Pools are opened for new addresses and
+	// drained for removed ones. Addrs is used if the first resolution fails.
+	// The resolver is closed with the client.
+	Resolver Resolver
+	// host:port addresses of backup thrift servers, used only while none
+	// of Addrs is available.
+	BackupAddrs []string
+	// Balancer picks the server of each call among Addrs, or BackupAddrs.
+	// Default is NewRoundRobinBalancer().
+	Balancer Balancer
+	// Zone, or rack, of the client. When set, calls go to the servers of
+	// Zone, and spill over to the other ones only while all servers of Zone
+	// are unavailable or saturated.
+	Zone string
+	// Zones maps the host:port addresses of the servers, from Addrs,
+	// BackupAddrs or the Resolver, to their zone.
+	Zones map[string]string
+	// Average wait for a free connection above which a server is saturated,
+	// see Zone. Default is 0, which makes servers of Zone used as long as
+	// they are available.
+	ZoneSpillWait time.Duration
+	// HostMapper maps the host and port of a region server to the address
+	// of the thrift server co-located with it, e.g. host+":9090", or ""
+	// if there is none. When set, single-row calls go to the thrift server
+	// of the region of their row if it is one of the known servers, and to
+	// the server picked by the Balancer otherwise. Region locations are
+	// loaded with GetAllRegionLocations, and cached from the results of
+	// GetAllRegionLocations and GetRegionLocation.
+	// Default is nil, which disables locality routing.
+	HostMapper func(host string, port int32) string
+	// Number of consecutive dial or transport errors that ejects a server
+	// from rotation. Default is 0, which disables this check.
+	EjectConsecutiveErrors int
+	// Average call latency above which a server is ejected from rotation.
+	// Default is 0, which disables this check.
+	EjectLatency time.Duration
+	// Time an ejected server stays out of rotation. After that, it is
+	// probed with a new validated connection before being readmitted.
+	// Default is 30 seconds.
+	EjectDuration time.Duration
 	// Maximum number of retries before giving up.
-	// Default is to not retry failed commands.
+	// Default is 3; -1 disables retries.
+	// Any command, Increment and Append included, is retried when its
+	// request was never sent. A sent request is only retried for the
+	// idempotent reads, i.e. Get, Exists, GetMultiple, scanner results and
+	// region locations, or when made with WithIdempotent.
 	MaxRetries int
+	// Minimum backoff between each retry.
+	// Default is 8 milliseconds; -1 disables backoff.
+	MinRetryBackoff time.Duration
+	// Maximum backoff between each retry.
+	// Default is 512 milliseconds; -1 disables backoff.
+	MaxRetryBackoff time.Duration
+	// Delay after which a read, i.e. Get, Exists or GetMultiple, that has
+	// not answered is sent again on another connection, possibly of another
+	// server. The first answer wins and the other call is cancelled.
+	// Default is 0, which disables hedging; -1 uses the 95th percentile of
+	// the latencies of recent reads.
+	HedgeDelay time.Duration
+	// TLS configuration of the connections, for servers run with
+	// hbase.thrift.ssl.enabled. Client certificates, for mutual TLS, can be
+	// reloaded on change with a CertReloader. ServerName defaults to the
+	// host of the server address.
+	// Default is nil, which uses plaintext connections.
+	TLSConfig *tls.Config
+	// Protocol of the thrift servers: ProtocolBinary, or ProtocolCompact for
+	// servers run with -compact.
+	// Default is ProtocolBinary.
+	Protocol Protocol
+	// Transport of the thrift servers: TransportFramed, as required by
+	// servers run with -nonblocking or -hsha, or TransportBuffered for
+	// servers run with -threadpool without -framed. It cannot be set in
+	// HTTP mode, nor with SASL.
+	// Default is TransportFramed.
+	Transport Transport
+	// StrictRead rejects messages of the binary protocol without a version
+	// header.
+	StrictRead bool
+	// NonStrictWrite writes messages of the binary protocol without a
+	// version header, for old servers only.
+	NonStrictWrite bool
+	// Size of the read and write buffers of each connection. Larger
+	// messages take several reads or writes.
+	// Default is 8 KiB.
+	BufferSize int
+	// SASL returns the SASL client authenticating a new connection to the
+	// server on host, for servers run with hbase.thrift.security.qop; see
+	// NewGSSAPISASL and NewPlainSASL. SASL frames messages itself, so
+	// Transport must be left to its default. It is not used in HTTP mode.
+	// Default is nil, which disables authentication.
+	SASL func(host string) (SASLClient, error)
+	// HTTP makes calls as HTTP POST requests, for servers run with
+	// hbase.regionserver.thrift.http, over HTTPS if TLSConfig is set.
+	// The network connections are those kept alive by HTTPClient. In this
+	// mode, ReadTimeout plus WriteTimeout bounds each request.
+	HTTP bool
+	// URL path of the thrift servers in HTTP mode. Default is "/".
+	HTTPPath string
+	// Headers added to the requests in HTTP mode, e.g. for authentication.
+	HTTPHeader http.Header
+	// HTTP client used in HTTP mode, shared by the pools of all servers.
+	// Default is a client keeping up to PoolSize idle connections alive per
+	// server.
+	HTTPClient *http.Client
+	// Dialer opens the network connections to the servers, e.g. through a
+	// SOCKS proxy or an SSH tunnel, or to a Unix socket whatever the
+	// address. ctx bounds the dial only, including DialTimeout. The TLS
+	// handshake, if any, runs on the returned connection. In HTTP mode, it
+	// is used by the default HTTPClient.
+	// Default is nil, which dials TCP connections.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 	// Dial timeout for establishing new connections.
 	// Default is 5 seconds.
 	DialTimeout time.Duration
+	// Minimum backoff between background dial attempts once PoolSize
+	// dials in a row have failed. Default is 100 milliseconds.
+	MinDialBackoff time.Duration
+	// Maximum backoff between background dial attempts.
+	// Default is 30 seconds.
+	MaxDialBackoff time.Duration
+	// Function called when the health state of the pool dialing addr
+	// changes, e.g. to flip a readiness probe. Calls are made one at a
+	// time, in the order of the transitions. It must not block.
+	OnStateChange func(addr string, from, to PoolState)
+	// Number of consecutive failed calls, i.e. dial or transport errors,
+	// that opens the circuit breaker of the endpoint. While open, calls
+	// fail fast with ErrBreakerOpen.
+	// Default is 0, which disables this check.
+	BreakerFailures int
+	// Failed calls ratio, between 0 and 1, that opens the circuit breaker
+	// once BreakerMinRequests calls were made within BreakerWindow.
+	// Default is 0, which disables this check.
+	BreakerErrorRate float64
+	// Window over which BreakerErrorRate is computed.
+	// Default is 10 seconds.
+	BreakerWindow time.Duration
+	// Minimum number of calls in a window before BreakerErrorRate applies.
+	// Default is 20 calls.
+	BreakerMinRequests int
+	// Time the circuit breaker stays open before letting a probe call
+	// through; the outcome of the probe closes or reopens it.
+	// Default is 5 seconds.
+	BreakerOpenTimeout time.Duration
 	// Timeout for socket reads. If reached, commands will fail
 	// with a timeout instead of blocking. Use value -1 for no timeout and 0 for default.
-	// Default is 3 seconds.
+	// Default is 3 seconds. WithReadTimeout overrides it for a single call.
 	ReadTimeout time.Duration
 	// Timeout for socket writes. If reached, commands will fail
 	// with a timeout instead of blocking.
-	// Default is ReadTimeout.
+	// Default is ReadTimeout. WithWriteTimeout overrides it for a single call.
 	WriteTimeout time.Duration
 	// Amount of time after which client closes idle connections.
 	// Should be less than server's timeout.
@@ -31,11 +176,30 @@ type Options struct {
 	// are busy before returning an error.
 	// Default is ReadTimeout + 1 second.
 	PoolTimeout time.Duration
+	// Connection age at which client retires (closes) the connection.
+	// Every connection gets a random jitter of up to 10% off this age, so
+	// that connections dialed together are not recycled together.
+	// Default is to not close aged connections.
+	MaxConnAge time.Duration
+	// Idle time after which a connection is validated before it is handed
+	// out, and by the idle connections reaper which replaces the dead ones.
+	// Default is 0, which disables validation.
+	ValidateIdleTime time.Duration
+	// Function used to validate a connection, e.g. with a cheap probe RPC.
+	// It runs as a call on the connection: its reads and writes are bounded
+	// by ReadTimeout and WriteTimeout, and cancelling the Get it validates
+	// for interrupts it.
+	// Default checks that the socket has not been closed by the server.
+	ValidateConn func(cn *ThriftConn) error
 	// Frequency of idle checks made by idle connections reaper.
 	// Default is 1 minute. -1 disables idle connections reaper,
 	// but idle connections are still discarded by the client
 	// if IdleTimeout is set.
 	IdleCheckFrequency time.Duration
+	// Maximum number of callers waiting, in FIFO order, for a free
+	// connection. Further callers fail fast with ErrPoolExhausted.
+	// Default is 0, which does not limit the number of waiters.
+	MaxWaiters int
 	// Maximum number of socket connections.
 	// Default is 10 connections per every CPU as reported by runtime.NumCPU.
 	PoolSize int
@@ -48,12 +212,59 @@ func (opt *Options) init() {
 	if opt.Addr == "" {
 		opt.Addr = "localhost:9090"
 	}
+	if len(opt.Addrs) == 0 {
+		opt.Addrs = []string{opt.Addr}
+	}
+	if opt.Balancer == nil {
+		opt.Balancer = NewRoundRobinBalancer()
+	}
+	if opt.EjectDuration == 0 {
+		opt.EjectDuration = 30 * time.Second
+	}
 	if opt.PoolSize == 0 {
 		opt.PoolSize = 10 * runtime.NumCPU()
 	}
+	switch {
+	case opt.MaxRetries == 0:
+		opt.MaxRetries = 3
+	case opt.MaxRetries < 0:
+		opt.MaxRetries = 0
+	}
+	switch opt.MinRetryBackoff {
+	case -1:
+		opt.MinRetryBackoff = 0
+	case 0:
+		opt.MinRetryBackoff = 8 * time.Millisecond
+	}
+	switch opt.MaxRetryBackoff {
+	case -1:
+		opt.MaxRetryBackoff = 0
+	case 0:
+		opt.MaxRetryBackoff = 512 * time.Millisecond
+	}
 	if opt.DialTimeout == 0 {
 		opt.DialTimeout = 5 * time.Second
 	}
+	if opt.BufferSize == 0 {
+		opt.BufferSize = defaultBufferSize
+	}
+
+	if opt.MinDialBackoff == 0 {
+		opt.MinDialBackoff = 100 * time.Millisecond
+	}
+	if opt.MaxDialBackoff == 0 {
+		opt.MaxDialBackoff = 30 * time.Second
+	}
+
+	if opt.BreakerWindow == 0 {
+		opt.BreakerWindow = 10 * time.Second
+	}
+	if opt.BreakerMinRequests == 0 {
+		opt.BreakerMinRequests = 20
+	}
+	if opt.BreakerOpenTimeout == 0 {
+		opt.BreakerOpenTimeout = 5 * time.Second
+	}
 
 	switch opt.ReadTimeout {
 	case -1:
@@ -78,4 +289,20 @@ func (opt *Options) init() {
 	if opt.IdleCheckFrequency == 0 {
 		opt.IdleCheckFrequency = time.Minute
 	}
+
+	if opt.HTTP {
+		if opt.HTTPPath == "" {
+			opt.HTTPPath = "/"
+		}
+		if opt.HTTPClient == nil {
+			opt.HTTPClient = newHTTPClient(opt)
+		}
+	}
+}
+
+// forAddr returns a copy of the options for the pool dialing addr.
+func (opt *Options) forAddr(addr string) *Options {
+	o := *opt
+	o.Addr = addr
+	return &o
 }
@@ -3,11 +3,29 @@
 package gohbase
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
 )
 
+// errConnExpired is the reason given when a connection reached MaxConnAge.
+var errConnExpired = errors.New("HBase: connection reached max age")
+
+// errUnexpectedRead is returned by connCheck when data is pending on an
+// idle connection.
+var errUnexpectedRead = errors.New("HBase: unexpected read from idle connection")
+
+// errConnGone is returned by GetConn when the connection left the pool.
+var errConnGone = &Error{Kind: ErrScannerExpired, Msg: "connection of the scanner was closed"}
+
 var timers = sync.Pool{
 	New: func() interface{} {
 		t := time.NewTimer(time.Hour)
@@ -25,18 +43,161 @@ type Stats struct {
 	TotalConns uint32 // number of total connections in the pool
 	IdleConns  uint32 // number of idle connections in the pool
 	StaleConns uint32 // number of stale connections removed from the pool
+
+	BrokenConns      uint32 // number of connections removed after a transport or protocol error
+	InterruptedConns uint32 // number of connections removed after a call was cancelled
+	ExpiredConns     uint32 // number of connections retired after reaching MaxConnAge
+	InvalidConns     uint32 // number of dead connections found by validation
+
+	WaitCount    uint32        // number of times a caller had to wait for a free connection
+	WaitDuration time.Duration // total time callers spent waiting for a free connection
+	Waiters      uint32        // number of callers currently waiting for a free connection
+	Exhausted    uint32        // number of callers turned away because MaxWaiters were waiting
+	WaitAverage  time.Duration // moving average of the wait for a free connection
+
+	BreakerState BreakerState // state of the circuit breaker; see HBase.PoolStats for the aggregate
+	BreakerTrips uint32       // number of times the circuit breaker opened
+
+	Ejected   bool   // whether the endpoint is ejected from rotation
+	Ejections uint32 // number of times the endpoint was ejected
+
+	Hedges    uint32 // number of reads sent again after HedgeDelay, reported by PoolStats only
+	HedgeWins uint32 // number of hedged reads first answered by the hedge
+}
+
+// waitAverageDecay is the time constant of waitAverage: a pool no caller
+// waited for since this long has about a third of its last average.
+const waitAverageDecay = time.Second
+
+// waitNegligible is the average wait below which waitAverage is zero.
+const waitNegligible = time.Microsecond
+
+// waitAverage is a moving average of the wait for a turn, which decays with
+// time so that a pool that gets no more traffic is not deemed busy forever.
+// Once it is zero, turns taken without waiting leave it untouched, without
+// locking.
+type waitAverage struct {
+	mu   sync.Mutex
+	avg  float64 // 纳秒
+	last time.Time
+	busy int32 // atomic, 为 1 表示 avg 不为零
+}
+
+func (w *waitAverage) decayedLocked(now time.Time) float64 {
+	if w.last.IsZero() {
+		return 0
+	}
+	return w.avg * math.Exp(-float64(now.Sub(w.last))/float64(waitAverageDecay))
+}
+
+func (w *waitAverage) add(d time.Duration) {
+	w.mu.Lock()
+	now := time.Now()
+	avg := w.decayedLocked(now)
+	w.avg = avg + (float64(d)-avg)/8
+	w.last = now
+	if w.avg < float64(waitNegligible) {
+		w.avg = 0
+		atomic.StoreInt32(&w.busy, 0)
+	} else {
+		atomic.StoreInt32(&w.busy, 1)
+	}
+	w.mu.Unlock()
+}
+
+// addNoWait records a turn taken without waiting.
+func (w *waitAverage) addNoWait() {
+	if atomic.LoadInt32(&w.busy) == 1 {
+		w.add(0)
+	}
+}
+
+func (w *waitAverage) value() time.Duration {
+	if atomic.LoadInt32(&w.busy) == 0 {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Duration(w.decayedLocked(time.Now()))
+}
+
+// PoolState is the health of a pool, as seen from its dial attempts.
+type PoolState int32
+
+const (
+	// StateHealthy means the last dial succeeded.
+	StateHealthy PoolState = iota
+	// StateDegraded means recent dials failed, but fewer than PoolSize.
+	StateDegraded
+	// StateDown means PoolSize dials in a row failed. New connections fail
+	// fast with the last dial error until a background dial succeeds.
+	StateDown
+)
+
+func (s PoolState) String() string {
+	switch s {
+	case StateHealthy:
+		return "healthy"
+	case StateDegraded:
+		return "degraded"
+	case StateDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+func (s *Stats) add(o *Stats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Timeouts += o.Timeouts
+
+	s.TotalConns += o.TotalConns
+	s.IdleConns += o.IdleConns
+	s.StaleConns += o.StaleConns
+
+	s.BrokenConns += o.BrokenConns
+	s.InterruptedConns += o.InterruptedConns
+	s.ExpiredConns += o.ExpiredConns
+	s.InvalidConns += o.InvalidConns
+
+	s.WaitCount += o.WaitCount
+	s.WaitDuration += o.WaitDuration
+	s.Waiters += o.Waiters
+	s.Exhausted += o.Exhausted
+	if o.WaitAverage > s.WaitAverage {
+		s.WaitAverage = o.WaitAverage
+	}
+
+	s.BreakerTrips += o.BreakerTrips
+
+	s.Ejections += o.Ejections
+
+	s.Hedges += o.Hedges
+	s.HedgeWins += o.HedgeWins
 }
 
 // Thrift连接池
 type ThriftConnPool struct {
+	waitDuration    int64 // atomic, 放在首位以保证 64 位对齐
 	opt             *Options
-	dialErrorsNum   uint32 // atomic
+	dialErrorsNum   uint32     // atomic
+	state           int32      // atomic, PoolState
+	stateMu         sync.Mutex // 串行化状态的计算与发布，保证 OnStateChange 按顺序调用
+	answered        uint32     // atomic, 为 1 表示已有调用成功完成
 	lastDialErrorMu sync.RWMutex
 	lastDialError   error
-	poolMu          sync.Mutex    // lock
-	queue           chan struct{} // 在用的链接队列
+	poolMu          sync.Mutex // lock
+	turnMu          sync.Mutex
+	turns           int       // 已被占用的名额数
+	waiters         list.List // 等待名额的协程，先进先出
+	breaker         *circuitBreaker
+	waitAvg         waitAverage
 	conns           []*ThriftConn
 	idleConns       []*ThriftConn
+	idleCh          chan struct{}   // 连接放回或移除时关闭并替换，用于唤醒 GetConn
+	ctx             context.Context // Close 时取消，中断后台拨号
+	cancel          context.CancelFunc
+	dials           sync.WaitGroup
 	poolSize        int
 	idleConnsLen    int
 	stats           Stats
@@ -46,22 +207,39 @@ type ThriftConnPool struct {
 func NewThriftConnPool(opt *Options) *ThriftConnPool {
 	p := &ThriftConnPool{
 		opt:       opt,
-		queue:     make(chan struct{}, opt.PoolSize),
+		breaker:   newCircuitBreaker(opt),
 		conns:     make([]*ThriftConn, 0, opt.PoolSize),
 		idleConns: make([]*ThriftConn, 0, opt.PoolSize),
+		idleCh:    make(chan struct{}),
 	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
 	for i := 0; i < opt.MinIdleConns; i++ {
 		p.checkMinIdleConns()
 	}
 
-	if opt.IdleTimeout > 0 && opt.IdleCheckFrequency > 0 {
+	if (opt.IdleTimeout > 0 || opt.MaxConnAge > 0 || opt.ValidateIdleTime > 0) && opt.IdleCheckFrequency > 0 {
 		go p.reaper(opt.IdleCheckFrequency)
 	}
 
 	return p
 }
 
+// Addr returns the address of the endpoint the pool dials.
+func (tp *ThriftConnPool) Addr() string {
+	return tp.opt.Addr
+}
+
+// available reports whether the endpoint may take calls: it is not down
+// and its circuit breaker is not open.
+func (tp *ThriftConnPool) available() bool {
+	if tp.State() == StateDown {
+		return false
+	}
+	state, _ := tp.breaker.stats()
+	return state != BreakerOpen
+}
+
 func (tp *ThriftConnPool) closed() bool {
 	return atomic.LoadUint32(&tp._closed) == 1
 }
@@ -107,6 +285,76 @@ func (tp *ThriftConnPool) ReapStaleConns() (int, error) {
 	return n, nil
 }
 
+// reapExpiredConns removes the idle connections that reached MaxConnAge.
+func (tp *ThriftConnPool) reapExpiredConns() int {
+	var expired []*ThriftConn
+
+	tp.poolMu.Lock()
+	idleConns := tp.idleConns[:0]
+	for _, cn := range tp.idleConns {
+		if tp.isExpiredConn(cn) {
+			expired = append(expired, cn)
+			tp.idleConnsLen--
+		} else {
+			idleConns = append(idleConns, cn)
+		}
+	}
+	tp.idleConns = idleConns
+	tp.poolMu.Unlock()
+
+	for _, cn := range expired {
+		_ = tp.CloseConn(cn)
+	}
+	return len(expired)
+}
+
+// checkIdleConns validates the connections idle for ValidateIdleTime and
+// closes the dead ones. Connections are taken out of the idle list while
+// being validated, so a slow probe does not hold the pool lock.
+func (tp *ThriftConnPool) checkIdleConns() int {
+	var checks []*ThriftConn
+
+	tp.poolMu.Lock()
+	idleConns := tp.idleConns[:0]
+	for _, cn := range tp.idleConns {
+		if tp.needsValidation(cn) {
+			checks = append(checks, cn)
+			tp.idleConnsLen--
+		} else {
+			idleConns = append(idleConns, cn)
+		}
+	}
+	tp.idleConns = idleConns
+	tp.poolMu.Unlock()
+
+	var n int
+	for _, cn := range checks {
+		if err := tp.validateConn(context.Background(), cn); err != nil {
+			_ = tp.CloseConn(cn)
+			n++
+			continue
+		}
+
+		tp.poolMu.Lock()
+		if tp.closed() {
+			tp.poolMu.Unlock()
+			_ = cn.Close()
+			continue
+		}
+		// 按最近使用时间插回原位置，保持 idleConns 有序
+		i := sort.Search(len(tp.idleConns), func(i int) bool {
+			return tp.idleConns[i].UsedTime().After(cn.UsedTime())
+		})
+		tp.idleConns = append(tp.idleConns, nil)
+		copy(tp.idleConns[i+1:], tp.idleConns[i:])
+		tp.idleConns[i] = cn
+		tp.idleConnsLen++
+		tp.notifyLocked()
+		tp.poolMu.Unlock()
+	}
+	return n
+}
+
 func (tp *ThriftConnPool) reaper(frequency time.Duration) {
 	ticker := time.NewTicker(frequency)
 	defer ticker.Stop()
@@ -115,6 +363,12 @@ func (tp *ThriftConnPool) reaper(frequency time.Duration) {
 		if tp.closed() {
 			break
 		}
+		n := tp.reapExpiredConns()
+		atomic.AddUint32(&tp.stats.ExpiredConns, uint32(n))
+
+		n = tp.checkIdleConns()
+		atomic.AddUint32(&tp.stats.InvalidConns, uint32(n))
+
 		n, err := tp.ReapStaleConns()
 		if err != nil {
 			// internal.Logf("ReapStaleConns failed: %s", err)
@@ -124,35 +378,119 @@ func (tp *ThriftConnPool) reaper(frequency time.Duration) {
 	}
 }
 
+// enqueue takes a free turn and returns nil, or else queues a waiter and
+// returns it. Turns are handed to waiters in FIFO order by freeTurn. If
+// shed is set and MaxWaiters callers are already waiting, it fails with
+// ErrPoolExhausted.
+func (tp *ThriftConnPool) enqueue(shed bool) (*list.Element, error) {
+	tp.turnMu.Lock()
+	defer tp.turnMu.Unlock()
+
+	if tp.turns < tp.opt.PoolSize && tp.waiters.Len() == 0 {
+		tp.turns++
+		return nil, nil
+	}
+	if shed && tp.opt.MaxWaiters > 0 && tp.waiters.Len() >= tp.opt.MaxWaiters {
+		return nil, ErrPoolExhausted
+	}
+	return tp.waiters.PushBack(make(chan struct{})), nil
+}
+
 func (tp *ThriftConnPool) getTurn() {
-	tp.queue <- struct{}{}
+	if e, _ := tp.enqueue(false); e != nil {
+		<-e.Value.(chan struct{})
+	}
 }
 
-func (tp *ThriftConnPool) waitTurn() error {
+func (tp *ThriftConnPool) waitTurn(ctx context.Context) error {
 	select {
-	case tp.queue <- struct{}{}:
-		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	default:
-		timer := timers.Get().(*time.Timer)
-		timer.Reset(tp.opt.PoolTimeout)
+	}
 
-		select {
-		case tp.queue <- struct{}{}:
-			if !timer.Stop() {
-				<-timer.C
-			}
-			timers.Put(timer)
-			return nil
-		case <-timer.C:
-			timers.Put(timer)
-			atomic.AddUint32(&tp.stats.Timeouts, 1)
-			return ErrPoolTimeout
+	e, err := tp.enqueue(true)
+	if err != nil {
+		atomic.AddUint32(&tp.stats.Exhausted, 1)
+		return err
+	}
+	if e == nil {
+		tp.waitAvg.addNoWait()
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		wait := time.Since(start)
+		atomic.AddUint32(&tp.stats.WaitCount, 1)
+		atomic.AddInt64(&tp.waitDuration, int64(wait))
+		tp.waitAvg.add(wait)
+	}()
+
+	ready := e.Value.(chan struct{})
+	timer := timers.Get().(*time.Timer)
+	timer.Reset(tp.opt.PoolTimeout)
+
+	select {
+	case <-ready:
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timers.Put(timer)
+		return nil
+	case <-ctx.Done():
+		if !timer.Stop() {
+			<-timer.C
 		}
+		timers.Put(timer)
+		err = ctx.Err()
+	case <-timer.C:
+		timers.Put(timer)
+		atomic.AddUint32(&tp.stats.Timeouts, 1)
+		err = ErrPoolTimeout
 	}
+
+	tp.turnMu.Lock()
+	select {
+	case <-ready:
+		// 放弃等待的同时拿到了名额，转交给下一个等待者
+		tp.freeTurnLocked()
+	default:
+		tp.waiters.Remove(e)
+	}
+	tp.turnMu.Unlock()
+	return err
 }
 
 func (tp *ThriftConnPool) freeTurn() {
-	<-tp.queue
+	tp.turnMu.Lock()
+	tp.freeTurnLocked()
+	tp.turnMu.Unlock()
+}
+
+func (tp *ThriftConnPool) freeTurnLocked() {
+	if e := tp.waiters.Front(); e != nil {
+		tp.waiters.Remove(e)
+		close(e.Value.(chan struct{}))
+		return
+	}
+	tp.turns--
+}
+
+// InFlight returns the number of calls holding or waiting for a connection.
+func (tp *ThriftConnPool) InFlight() int {
+	tp.turnMu.Lock()
+	n := tp.turns + tp.waiters.Len()
+	tp.turnMu.Unlock()
+	return n
+}
+
+// Waiters returns the number of callers waiting for a free connection.
+func (tp *ThriftConnPool) Waiters() int {
+	tp.turnMu.Lock()
+	n := tp.waiters.Len()
+	tp.turnMu.Unlock()
+	return n
 }
 
 func (tp *ThriftConnPool) setLastDialError(err error) {
@@ -170,6 +508,7 @@ func (tp *ThriftConnPool) getLastDialError() error {
 
 func (tp *ThriftConnPool) Stats() *Stats {
 	idleLen := tp.IdleLen()
+	breakerState, breakerTrips := tp.breaker.stats()
 	return &Stats{
 		Hits:     atomic.LoadUint32(&tp.stats.Hits),
 		Misses:   atomic.LoadUint32(&tp.stats.Misses),
@@ -178,30 +517,104 @@ func (tp *ThriftConnPool) Stats() *Stats {
 		TotalConns: uint32(tp.Len()),
 		IdleConns:  uint32(idleLen),
 		StaleConns: atomic.LoadUint32(&tp.stats.StaleConns),
+
+		BrokenConns:      atomic.LoadUint32(&tp.stats.BrokenConns),
+		InterruptedConns: atomic.LoadUint32(&tp.stats.InterruptedConns),
+		ExpiredConns:     atomic.LoadUint32(&tp.stats.ExpiredConns),
+		InvalidConns:     atomic.LoadUint32(&tp.stats.InvalidConns),
+
+		WaitCount:    atomic.LoadUint32(&tp.stats.WaitCount),
+		WaitDuration: time.Duration(atomic.LoadInt64(&tp.waitDuration)),
+		Waiters:      uint32(tp.Waiters()),
+		Exhausted:    atomic.LoadUint32(&tp.stats.Exhausted),
+		WaitAverage:  tp.waitAvg.value(),
+
+		BreakerState: breakerState,
+		BreakerTrips: breakerTrips,
 	}
 }
 
-// 尝试拨号/链接
+// State returns the health state of the pool.
+func (tp *ThriftConnPool) State() PoolState {
+	return PoolState(atomic.LoadInt32(&tp.state))
+}
+
+// updateState derives the state from the dial errors in a row and reports
+// a transition to Options.OnStateChange. Transitions are reported one at a
+// time, in the order they are published.
+func (tp *ThriftConnPool) updateState() {
+	tp.stateMu.Lock()
+	defer tp.stateMu.Unlock()
+
+	state := StateHealthy
+	switch n := atomic.LoadUint32(&tp.dialErrorsNum); {
+	case n >= uint32(tp.opt.PoolSize):
+		state = StateDown
+	case n > 0:
+		state = StateDegraded
+	}
+
+	old := PoolState(atomic.SwapInt32(&tp.state, int32(state)))
+	if old != state && tp.opt.OnStateChange != nil {
+		tp.opt.OnStateChange(tp.opt.Addr, old, state)
+	}
+}
+
+// probe dials a connection outside of the pool and validates it. The dial
+// is aborted when ctx is done.
+func (tp *ThriftConnPool) probe(ctx context.Context) error {
+	cn, err := newThriftConn(ctx, tp.opt)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+	return tp.validateConn(ctx, cn)
+}
+
+// startDial starts tryDial, unless the pool is closed.
+func (tp *ThriftConnPool) startDial() {
+	tp.poolMu.Lock()
+	defer tp.poolMu.Unlock()
+	if tp.closed() {
+		return
+	}
+	tp.dials.Add(1)
+	go tp.tryDial()
+}
+
+// 尝试拨号/链接，失败后按指数退避重试，直到连接池关闭
 func (tp *ThriftConnPool) tryDial() {
-	for {
-		if tp.closed() {
+	defer tp.dials.Done()
+	for attempt := 0; ; attempt++ {
+		conn, err := newThriftConn(tp.ctx, tp.opt)
+		if tp.ctx.Err() != nil {
+			if err == nil {
+				_ = conn.Close()
+			}
 			return
 		}
-
-		conn, err := NewThriftConn(tp.opt.Addr, tp.opt.DialTimeout)
 		if err != nil {
 			tp.setLastDialError(err)
-			time.Sleep(time.Second)
+			backoff := retryBackoff(attempt, tp.opt.MinDialBackoff, tp.opt.MaxDialBackoff)
+			if backoff < tp.opt.MinDialBackoff {
+				backoff = tp.opt.MinDialBackoff
+			}
+			if sleep(tp.ctx, backoff) != nil {
+				return
+			}
 			continue
 		}
 
 		atomic.StoreUint32(&tp.dialErrorsNum, 0)
+		tp.updateState()
 		_ = conn.Close()
 		return
 	}
 }
 
-func (tp *ThriftConnPool) newConn(pooled bool) (*ThriftConn, error) {
+// newConn dials a connection for the pool. If ctx is done before, the dial
+// is aborted without counting as a dial error.
+func (tp *ThriftConnPool) newConn(ctx context.Context, pooled bool) (*ThriftConn, error) {
 	if tp.closed() {
 		return nil, ErrClosed
 	}
@@ -210,20 +623,32 @@ func (tp *ThriftConnPool) newConn(pooled bool) (*ThriftConn, error) {
 		return nil, tp.getLastDialError()
 	}
 
-	conn, err := NewThriftConn(tp.opt.Addr, tp.opt.DialTimeout)
+	conn, err := newThriftConn(ctx, tp.opt)
+	if err != nil && ctxErr(ctx) != nil {
+		return nil, ctxErr(ctx)
+	}
 	if err != nil {
 		tp.setLastDialError(err)
 		if atomic.AddUint32(&tp.dialErrorsNum, 1) == uint32(tp.opt.PoolSize) {
-			go tp.tryDial()
+			tp.startDial()
 		}
+		tp.updateState()
 		return nil, err
 	}
+	if atomic.LoadUint32(&tp.dialErrorsNum) > 0 {
+		atomic.StoreUint32(&tp.dialErrorsNum, 0)
+		tp.updateState()
+	}
 	conn.pooled = pooled
+	if age := tp.opt.MaxConnAge; age > 0 {
+		jitter := time.Duration(rand.Int63n(int64(age)/10 + 1))
+		conn.expireTime = conn.createTime.Add(age - jitter)
+	}
 	return conn, nil
 }
 
 func (tp *ThriftConnPool) addIdleConn() {
-	cn, err := tp.newConn(true)
+	cn, err := tp.newConn(context.Background(), true)
 	if err != nil {
 		return
 	}
@@ -259,7 +684,7 @@ func (tp *ThriftConnPool) popIdle() *ThriftConn {
 }
 
 func (tp *ThriftConnPool) isStaleConn(cn *ThriftConn) bool {
-	if tp.opt.IdleTimeout == 0 {
+	if tp.opt.IdleTimeout == 0 || cn.pinned() {
 		return false
 	}
 
@@ -271,6 +696,35 @@ func (tp *ThriftConnPool) isStaleConn(cn *ThriftConn) bool {
 	return false
 }
 
+func (tp *ThriftConnPool) isExpiredConn(cn *ThriftConn) bool {
+	return !cn.expireTime.IsZero() && !cn.pinned() && time.Now().After(cn.expireTime)
+}
+
+func (tp *ThriftConnPool) needsValidation(cn *ThriftConn) bool {
+	return tp.opt.ValidateIdleTime > 0 && time.Since(cn.UsedTime()) >= tp.opt.ValidateIdleTime
+}
+
+// validateConn checks that cn is still usable. Options.ValidateConn runs
+// as a call on cn, bounded by ReadTimeout and WriteTimeout and interrupted
+// when ctx is done.
+func (tp *ThriftConnPool) validateConn(ctx context.Context, cn *ThriftConn) error {
+	if tp.opt.ValidateConn != nil {
+		return cn.call(ctx, tp.opt.ReadTimeout, tp.opt.WriteTimeout, func(*hbase.THBaseServiceClient) error {
+			return tp.opt.ValidateConn(cn)
+		})
+	}
+	if cn.rawConn == nil {
+		// HTTP 模式下由 http.Client 管理网络连接
+		return nil
+	}
+	err := connCheck(cn.rawConn)
+	if cn.rawConn != cn.netConn.Conn && (err == nil || err == errUnexpectedRead) {
+		// 空闲的 TLS 连接上可能有服务端在握手后发送的会话票据，经 TLS 层读取以区分
+		return tlsCheck(cn.netConn.Conn, err == errUnexpectedRead)
+	}
+	return err
+}
+
 func (tp *ThriftConnPool) removeConn(cn *ThriftConn) {
 	tp.poolMu.Lock()
 	for i, c := range tp.conns {
@@ -280,16 +734,35 @@ func (tp *ThriftConnPool) removeConn(cn *ThriftConn) {
 				tp.poolSize--
 				tp.checkMinIdleConns()
 			}
+			tp.notifyLocked()
 			break
 		}
 	}
 	tp.poolMu.Unlock()
 }
 
+// Remove closes a connection obtained by Get instead of returning it to the
+// pool. reason is the error that made the connection unusable, if any.
 func (tp *ThriftConnPool) Remove(cn *ThriftConn, reason error) {
 	tp.removeConn(cn)
 	tp.freeTurn()
 	_ = cn.Close()
+
+	switch {
+	case reason == nil:
+		tp.breaker.done(false)
+	case reason == context.Canceled || reason == context.DeadlineExceeded:
+		atomic.AddUint32(&tp.stats.InterruptedConns, 1)
+		tp.breaker.cancel()
+	case reason == errConnExpired:
+		atomic.AddUint32(&tp.stats.ExpiredConns, 1)
+		tp.breaker.done(false)
+	case errors.Is(reason, ErrConnBroken):
+		atomic.AddUint32(&tp.stats.BrokenConns, 1)
+		tp.breaker.done(true)
+	default:
+		tp.breaker.done(false)
+	}
 }
 
 // CloseConn 关闭链接并从连接池中移除
@@ -300,7 +773,12 @@ func (tp *ThriftConnPool) CloseConn(cn *ThriftConn) error {
 
 // NewConn 创建链接
 func (tp *ThriftConnPool) NewConn(pooled bool) (*ThriftConn, error) {
-	cn, err := tp.newConn(pooled)
+	return tp.addConn(context.Background(), pooled)
+}
+
+// addConn is NewConn, aborted when ctx is done.
+func (tp *ThriftConnPool) addConn(ctx context.Context, pooled bool) (*ThriftConn, error) {
+	cn, err := tp.newConn(ctx, pooled)
 	if err != nil {
 		return nil, err
 	}
@@ -318,14 +796,29 @@ func (tp *ThriftConnPool) NewConn(pooled bool) (*ThriftConn, error) {
 	return cn, nil
 }
 
-//
+// Get returns an idle connection or dials a new one. It is GetContext
+// with context.Background().
 func (tp *ThriftConnPool) Get() (*ThriftConn, error) {
+	return tp.GetContext(context.Background())
+}
+
+// GetContext returns an idle connection or dials a new one. Waiting for a
+// free turn is bounded by PoolTimeout, and both the wait and the dial are
+// aborted when ctx is done. It fails fast with ErrBreakerOpen while the
+// circuit breaker is open. The connection must be given back with Put or
+// Remove.
+func (tp *ThriftConnPool) GetContext(ctx context.Context) (*ThriftConn, error) {
 	if tp.closed() {
 		return nil, ErrClosed
 	}
 
-	err := tp.waitTurn()
+	if err := tp.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	err := tp.waitTurn(ctx)
 	if err != nil {
+		tp.breaker.cancel()
 		return nil, err
 	}
 
@@ -342,6 +835,22 @@ func (tp *ThriftConnPool) Get() (*ThriftConn, error) {
 			_ = tp.CloseConn(cn)
 			continue
 		}
+		if tp.isExpiredConn(cn) {
+			_ = tp.CloseConn(cn)
+			atomic.AddUint32(&tp.stats.ExpiredConns, 1)
+			continue
+		}
+		if tp.needsValidation(cn) && tp.validateConn(ctx, cn) != nil {
+			_ = tp.CloseConn(cn)
+			if err := ctxErr(ctx); err != nil {
+				// 校验被中断，不代表连接失效，也不再校验其余空闲连接
+				tp.freeTurn()
+				tp.breaker.cancel()
+				return nil, err
+			}
+			atomic.AddUint32(&tp.stats.InvalidConns, 1)
+			continue
+		}
 
 		atomic.AddUint32(&tp.stats.Hits, 1)
 		return cn, nil
@@ -349,28 +858,143 @@ func (tp *ThriftConnPool) Get() (*ThriftConn, error) {
 
 	atomic.AddUint32(&tp.stats.Misses, 1)
 
-	newcn, err := tp.NewConn(true)
+	newcn, err := tp.addConn(ctx, true)
 	if err != nil {
 		tp.freeTurn()
+		if err == ErrClosed || err == ctx.Err() {
+			tp.breaker.cancel()
+		} else {
+			tp.breaker.done(true)
+		}
 		return nil, err
 	}
 
 	return newcn, nil
 }
 
-//
+// Put returns a connection obtained by Get to the pool.
 func (tp *ThriftConnPool) Put(cn *ThriftConn) {
 	if !cn.pooled {
 		tp.Remove(cn, nil)
 		return
 	}
+	if tp.isExpiredConn(cn) {
+		tp.Remove(cn, errConnExpired)
+		return
+	}
 
 	tp.poolMu.Lock()
 	_ = cn.UpdateUsedTime()
 	tp.idleConns = append(tp.idleConns, cn)
 	tp.idleConnsLen++
+	tp.notifyLocked()
 	tp.poolMu.Unlock()
 	tp.freeTurn()
+	tp.breaker.done(false)
+}
+
+// hasPinned reports whether a Scanner is bound to a connection of the pool.
+func (tp *ThriftConnPool) hasPinned() bool {
+	tp.poolMu.Lock()
+	defer tp.poolMu.Unlock()
+
+	for _, cn := range tp.conns {
+		if cn.pinned() {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyLocked wakes up the callers of GetConn waiting for a connection
+// to come back to, or leave, the pool. It must be called with poolMu held.
+func (tp *ThriftConnPool) notifyLocked() {
+	close(tp.idleCh)
+	tp.idleCh = make(chan struct{})
+}
+
+// takeIdle removes cn from the idle connections. ok is false if cn is no
+// longer part of the pool.
+func (tp *ThriftConnPool) takeIdle(cn *ThriftConn) (taken, ok bool) {
+	if tp.closed() || cn.IsClose() {
+		return false, false
+	}
+	for i, c := range tp.idleConns {
+		if c == cn {
+			tp.idleConns = append(tp.idleConns[:i], tp.idleConns[i+1:]...)
+			tp.idleConnsLen--
+			tp.checkMinIdleConns()
+			return true, true
+		}
+	}
+	for _, c := range tp.conns {
+		if c == cn {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// GetConn is Get for a given connection of the pool, such as the one a
+// scanner was opened on. It waits until cn is idle, bounded by PoolTimeout
+// and ctx, and fails with errConnGone if cn was closed in the meantime.
+// The connection must be given back with Put or Remove.
+func (tp *ThriftConnPool) GetConn(ctx context.Context, cn *ThriftConn) error {
+	if tp.closed() {
+		return ErrClosed
+	}
+
+	if err := tp.breaker.allow(); err != nil {
+		return err
+	}
+
+	if err := tp.waitTurn(ctx); err != nil {
+		tp.breaker.cancel()
+		return err
+	}
+
+	timer := timers.Get().(*time.Timer)
+	timer.Reset(tp.opt.PoolTimeout)
+	stopTimer := func() {
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timers.Put(timer)
+	}
+
+	var err error
+	for err == nil {
+		tp.poolMu.Lock()
+		taken, ok := tp.takeIdle(cn)
+		idleCh := tp.idleCh
+		tp.poolMu.Unlock()
+
+		if taken {
+			stopTimer()
+			atomic.AddUint32(&tp.stats.Hits, 1)
+			return nil
+		}
+		if !ok {
+			stopTimer()
+			err = errConnGone
+			break
+		}
+
+		select {
+		case <-idleCh:
+		case <-ctx.Done():
+			stopTimer()
+			err = ctx.Err()
+		case <-timer.C:
+			timers.Put(timer)
+			atomic.AddUint32(&tp.stats.Timeouts, 1)
+			err = ErrPoolTimeout
+		}
+	}
+
+	tp.freeTurn()
+	tp.breaker.cancel()
+	return err
 }
 
 // Len returns total number of connections.
@@ -393,6 +1017,7 @@ func (tp *ThriftConnPool) Close() error {
 	if !atomic.CompareAndSwapUint32(&tp._closed, 0, 1) {
 		return ErrClosed
 	}
+	tp.cancel()
 
 	var firstErr error
 	tp.poolMu.Lock()
@@ -405,7 +1030,9 @@ func (tp *ThriftConnPool) Close() error {
 	tp.poolSize = 0
 	tp.idleConns = nil
 	tp.idleConnsLen = 0
+	tp.notifyLocked()
 	tp.poolMu.Unlock()
 
+	tp.dials.Wait()
 	return firstErr
 }
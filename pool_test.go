@@ -0,0 +1,595 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestPoolGet(t *testing.T) {
+	opt := &Options{Addr: newTestServer(t, &fakeHandler{}), PoolSize: 1}
+	opt.init()
+	pool := NewThriftConnPool(opt)
+	defer pool.Close()
+
+	cn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(cn)
+	if n := pool.IdleLen(); n != 1 {
+		t.Fatalf("pool has %d idle connections after Put, want 1", n)
+	}
+	if cn2, err := pool.Get(); err != nil || cn2 != cn {
+		t.Errorf("Get = %p, %v, want the idle connection %p", cn2, err, cn)
+	}
+}
+
+func TestWaitAverage(t *testing.T) {
+	var w waitAverage
+	if d := w.value(); d != 0 {
+		t.Fatalf("value = %s before any wait, want 0", d)
+	}
+
+	w.add(80 * time.Millisecond)
+	if d := w.value(); d < 9*time.Millisecond || d > 10*time.Millisecond {
+		t.Errorf("value = %s after a wait of 80ms, want about 10ms", d)
+	}
+
+	// 不排队的调用将平均值拉回零，之后不再加锁
+	for i := 0; i < 200 && w.busy == 1; i++ {
+		w.addNoWait()
+	}
+	if d := w.value(); d != 0 || w.busy != 0 {
+		t.Errorf("value = %s after turns without wait, want 0", d)
+	}
+}
+
+func BenchmarkWaitAverageNoWait(b *testing.B) {
+	var w waitAverage
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w.addNoWait()
+		}
+	})
+}
+
+func TestMaxConnAge(t *testing.T) {
+	addr := newTestServer(t, &fakeHandler{})
+
+	t.Run("jitter", func(t *testing.T) {
+		opt := &Options{Addr: addr, MaxConnAge: time.Second}
+		opt.init()
+		pool := NewThriftConnPool(opt)
+		defer pool.Close()
+
+		// 过期时间提前至多 10%，避免同时建立的连接同时过期
+		var jittered bool
+		for i := 0; i < 20; i++ {
+			cn, err := pool.newConn(context.Background(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			age := cn.expireTime.Sub(cn.createTime)
+			if age < 900*time.Millisecond || age > time.Second {
+				t.Errorf("connection expires after %s, want within 10%% below %s", age, opt.MaxConnAge)
+			}
+			jittered = jittered || age < time.Second
+			_ = cn.Close()
+		}
+		if !jittered {
+			t.Error("no connection expires before MaxConnAge")
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		expire func(t *testing.T, pool *ThriftConnPool, cn *ThriftConn)
+	}{
+		{"get", func(t *testing.T, pool *ThriftConnPool, cn *ThriftConn) {
+			pool.Put(cn)
+			time.Sleep(60 * time.Millisecond)
+			cn2, err := pool.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cn2 == cn {
+				t.Error("Get returned an expired connection")
+			}
+			pool.Put(cn2)
+		}},
+		{"put", func(t *testing.T, pool *ThriftConnPool, cn *ThriftConn) {
+			time.Sleep(60 * time.Millisecond)
+			pool.Put(cn)
+			if n := pool.Len(); n != 0 {
+				t.Errorf("pool has %d connections after putting an expired one, want 0", n)
+			}
+		}},
+		{"reaper", func(t *testing.T, pool *ThriftConnPool, cn *ThriftConn) {
+			pool.Put(cn)
+			deadline := time.Now().Add(time.Second)
+			for pool.Len() != 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := pool.Len(); n != 0 {
+				t.Errorf("pool has %d connections after MaxConnAge, want 0", n)
+			}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			opt := &Options{Addr: addr, MaxConnAge: 50 * time.Millisecond, IdleCheckFrequency: time.Hour}
+			if tc.name == "reaper" {
+				opt.IdleCheckFrequency = 10 * time.Millisecond
+			}
+			opt.init()
+			pool := NewThriftConnPool(opt)
+			defer pool.Close()
+
+			cn, err := pool.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cn.expireTime.IsZero() {
+				t.Fatal("connection has no expiry with MaxConnAge set")
+			}
+			tc.expire(t, pool, cn)
+			if !cn.IsClose() {
+				t.Error("expired connection is not closed")
+			}
+			if n := pool.Stats().ExpiredConns; n != 1 {
+				t.Errorf("ExpiredConns = %d, want 1", n)
+			}
+		})
+	}
+}
+
+// existsHandler answers Exists, or blocks it until release is closed when
+// hang is set.
+type existsHandler struct {
+	fakeHandler
+	hang    bool
+	release chan struct{}
+}
+
+func (h *existsHandler) Exists(table []byte, tget *hbase.TGet) (bool, error) {
+	if h.hang {
+		<-h.release
+	}
+	return true, nil
+}
+
+func TestValidateConn(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		hang        bool
+		readTimeout time.Duration
+		ctxTimeout  time.Duration
+		reaper      bool
+		err         error // GetContext 的错误
+		reused      bool  // GetContext 是否返回原连接
+		invalid     uint32
+	}{
+		{name: "borrow", reused: true},
+		{name: "borrow read timeout", hang: true, readTimeout: 50 * time.Millisecond, invalid: 1},
+		{name: "borrow cancel", hang: true, readTimeout: -1, ctxTimeout: 50 * time.Millisecond, err: context.DeadlineExceeded},
+		{name: "reaper", reaper: true, reused: true},
+		{name: "reaper read timeout", hang: true, readTimeout: 50 * time.Millisecond, reaper: true, invalid: 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &existsHandler{hang: tc.hang, release: make(chan struct{})}
+			addr := newTestServer(t, handler)
+			t.Cleanup(func() { close(handler.release) })
+
+			var validated int32
+			opt := &Options{
+				Addr:               addr,
+				ReadTimeout:        tc.readTimeout,
+				ValidateIdleTime:   time.Nanosecond,
+				IdleCheckFrequency: time.Hour,
+				ValidateConn: func(cn *ThriftConn) error {
+					atomic.AddInt32(&validated, 1)
+					_, err := cn.GetHbaseClient().Exists([]byte("t"), &hbase.TGet{Row: []byte("row")})
+					return err
+				},
+			}
+			if tc.reaper {
+				opt.IdleCheckFrequency = 10 * time.Millisecond
+			}
+			opt.init()
+			pool := NewThriftConnPool(opt)
+			defer pool.Close()
+
+			cn, err := pool.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.Put(cn)
+
+			if tc.reaper {
+				// 等待回收协程校验空闲连接
+				deadline := time.Now().Add(time.Second)
+				for time.Now().Before(deadline) {
+					// 第二次校验开始时，第一次校验已经结束
+					if tc.invalid > 0 && pool.Stats().InvalidConns > 0 || tc.invalid == 0 && atomic.LoadInt32(&validated) > 1 {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if n := pool.Stats().InvalidConns; n != tc.invalid {
+					t.Fatalf("reaper closed %d invalid connections, want %d", n, tc.invalid)
+				}
+				if cn.IsClose() == tc.reused {
+					t.Errorf("connection closed by the reaper: %v, want %v", cn.IsClose(), !tc.reused)
+				}
+				return
+			}
+
+			ctx := context.Background()
+			if tc.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+			start := time.Now()
+			cn2, err := pool.GetContext(ctx)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("GetContext returned after %s", d)
+			}
+			if err != tc.err {
+				t.Fatalf("GetContext = %v, want %v", err, tc.err)
+			}
+			if err == nil {
+				defer pool.Put(cn2)
+				if (cn2 == cn) != tc.reused {
+					t.Errorf("GetContext reused the idle connection: %v, want %v", cn2 == cn, tc.reused)
+				}
+			}
+			if atomic.LoadInt32(&validated) != 1 {
+				t.Errorf("validated %d times, want 1", validated)
+			}
+			if !tc.reused && !cn.IsClose() {
+				t.Error("connection failing validation is not closed")
+			}
+			if n := pool.Stats().InvalidConns; n != tc.invalid {
+				t.Errorf("InvalidConns = %d, want %d", n, tc.invalid)
+			}
+		})
+	}
+}
+
+// newTurnPool returns a pool of a single turn that never dials.
+func newTurnPool(t *testing.T, maxWaiters int) *ThriftConnPool {
+	opt := &Options{Addr: "thrift1:9090", PoolSize: 1, MaxWaiters: maxWaiters, PoolTimeout: time.Hour}
+	opt.init()
+	pool := NewThriftConnPool(opt)
+	t.Cleanup(func() { _ = pool.Close() })
+	return pool
+}
+
+// waitWaiters waits until n callers wait for a turn of pool.
+func waitWaiters(t *testing.T, pool *ThriftConnPool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for pool.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers wait for a turn, want %d", pool.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitTurnFIFO(t *testing.T) {
+	pool := newTurnPool(t, 0)
+	if err := pool.waitTurn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := pool.waitTurn(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			pool.freeTurn()
+		}(i)
+		// 按顺序入队
+		waitWaiters(t, pool, i+1)
+	}
+
+	pool.freeTurn()
+	wg.Wait()
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("waiters got their turn in order %v, want FIFO", order)
+		}
+	}
+	if n := pool.InFlight(); n != 0 {
+		t.Errorf("InFlight = %d after all turns were freed, want 0", n)
+	}
+}
+
+func TestWaitTurnExhausted(t *testing.T) {
+	pool := newTurnPool(t, 2)
+	if err := pool.waitTurn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.waitTurn(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			pool.freeTurn()
+		}()
+	}
+	waitWaiters(t, pool, 2)
+
+	if err := pool.waitTurn(context.Background()); err != ErrPoolExhausted {
+		t.Errorf("waitTurn with MaxWaiters waiting = %v, want %v", err, ErrPoolExhausted)
+	}
+	if n := pool.Stats().Exhausted; n != 1 {
+		t.Errorf("Exhausted = %d, want 1", n)
+	}
+
+	pool.freeTurn()
+	wg.Wait()
+	if err := pool.waitTurn(context.Background()); err != nil {
+		t.Errorf("waitTurn once the waiters left = %v", err)
+	}
+}
+
+func TestWaitTurnPassOn(t *testing.T) {
+	pool := newTurnPool(t, 0)
+	if err := pool.waitTurn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- pool.waitTurn(ctx) }()
+	waitWaiters(t, pool, 1)
+	second := make(chan error, 1)
+	go func() { second <- pool.waitTurn(context.Background()) }()
+	waitWaiters(t, pool, 2)
+
+	// 第一个等待者放弃等待后、取得锁之前，名额交给了它
+	pool.turnMu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	pool.freeTurnLocked()
+	pool.turnMu.Unlock()
+
+	if err := <-first; err != context.Canceled {
+		t.Errorf("waitTurn of the cancelled waiter = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the turn was not passed on to the next waiter")
+	}
+	if n := pool.InFlight(); n != 1 {
+		t.Errorf("InFlight = %d, want 1", n)
+	}
+	pool.freeTurn()
+	if n := pool.InFlight(); n != 0 {
+		t.Errorf("InFlight = %d after all turns were freed, want 0", n)
+	}
+}
+
+// stateRecorder records the transitions reported to OnStateChange.
+type stateRecorder struct {
+	mu          sync.Mutex
+	transitions []string
+}
+
+func (r *stateRecorder) onStateChange(addr string, from, to PoolState) {
+	r.mu.Lock()
+	r.transitions = append(r.transitions, from.String()+">"+to.String())
+	r.mu.Unlock()
+}
+
+func (r *stateRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.transitions...)
+}
+
+func TestPoolState(t *testing.T) {
+	addr := newTestServer(t, &fakeHandler{})
+	var fail int32
+	var rec stateRecorder
+	opt := &Options{
+		Addr: addr,
+		Dialer: func(ctx context.Context, network, a string) (net.Conn, error) {
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, a)
+		},
+		PoolSize:       2,
+		MinDialBackoff: 10 * time.Millisecond,
+		MaxDialBackoff: 10 * time.Millisecond,
+		OnStateChange:  rec.onStateChange,
+	}
+	opt.init()
+	pool := NewThriftConnPool(opt)
+	defer pool.Close()
+
+	get := func(wantErr bool) {
+		t.Helper()
+		cn, err := pool.Get()
+		if (err != nil) != wantErr {
+			t.Fatalf("Get = %v, want error %v", err, wantErr)
+		}
+		if err == nil {
+			pool.Remove(cn, nil)
+		}
+	}
+	expect := func(state PoolState) {
+		t.Helper()
+		if s := pool.State(); s != state {
+			t.Fatalf("pool is %s, want %s", s, state)
+		}
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	get(true)
+	expect(StateDegraded)
+	get(true)
+	expect(StateDown)
+	// 连接池关闭前，新连接直接返回上次的拨号错误
+	get(true)
+	expect(StateDown)
+
+	// 后台拨号成功后恢复
+	atomic.StoreInt32(&fail, 0)
+	deadline := time.Now().Add(time.Second)
+	for pool.State() != StateHealthy && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	expect(StateHealthy)
+
+	atomic.StoreInt32(&fail, 1)
+	get(true)
+	expect(StateDegraded)
+	atomic.StoreInt32(&fail, 0)
+	get(false)
+	expect(StateHealthy)
+
+	want := []string{"healthy>degraded", "degraded>down", "down>healthy", "healthy>degraded", "degraded>healthy"}
+	if got := rec.get(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("OnStateChange saw %q, want %q", got, want)
+	}
+}
+
+func TestPoolStateOrder(t *testing.T) {
+	addr := newTestServer(t, &fakeHandler{})
+	var dials uint32
+	var rec stateRecorder
+	opt := &Options{
+		Addr: addr,
+		// 三分之二的拨号失败
+		Dialer: func(ctx context.Context, network, a string) (net.Conn, error) {
+			if atomic.AddUint32(&dials, 1)%3 != 0 {
+				return nil, errors.New("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, a)
+		},
+		PoolSize:       3,
+		MinDialBackoff: time.Millisecond,
+		MaxDialBackoff: time.Millisecond,
+		OnStateChange:  rec.onStateChange,
+	}
+	opt.init()
+	pool := NewThriftConnPool(opt)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if cn, err := pool.Get(); err == nil {
+					pool.Remove(cn, nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	_ = pool.Close()
+
+	// 每次变化都从上一次变化的状态开始，最后一次变化到当前状态
+	from := StateHealthy.String()
+	transitions := rec.get()
+	for _, tr := range transitions {
+		states := strings.Split(tr, ">")
+		if states[0] != from || states[0] == states[1] {
+			t.Fatalf("OnStateChange saw %q out of order", transitions)
+		}
+		from = states[1]
+	}
+	if from != pool.State().String() {
+		t.Errorf("last transition is to %s, pool is %s", from, pool.State())
+	}
+	if len(transitions) == 0 {
+		t.Error("OnStateChange was not called")
+	}
+}
+
+func TestPoolCloseStopsDial(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		block bool // 后台拨号是否阻塞
+	}{
+		{"backoff", false},
+		{"dial", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var dials int32
+			opt := &Options{
+				Addr: "thrift1:9090",
+				Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if atomic.AddInt32(&dials, 1) > 1 && tc.block {
+						<-ctx.Done()
+						return nil, ctx.Err()
+					}
+					return nil, errors.New("connection refused")
+				},
+				PoolSize:       1,
+				DialTimeout:    time.Hour,
+				MinDialBackoff: time.Hour,
+				MaxDialBackoff: time.Hour,
+			}
+			opt.init()
+			pool := NewThriftConnPool(opt)
+			if _, err := pool.Get(); err == nil {
+				t.Fatal("Get succeeded with a failing dialer")
+			}
+			// 等待后台拨号开始
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&dials) < 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				_ = pool.Close()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Close did not stop the background dial")
+			}
+			if n := atomic.LoadInt32(&dials); n != 2 {
+				t.Errorf("dialed %d times, want 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// ErrProtocolMismatch is the kind of the errors returned when the
+// connection to a server, no call to which ever succeeded, breaks during a
+// call: most likely the protocol or transport of the client does not match
+// the one of the server. Such errors also match ErrConnBroken.
+var ErrProtocolMismatch = errors.New("HBase: protocol mismatch")
+
+// Protocol is a thrift protocol, i.e. an encoding of the messages.
+type Protocol int
+
+const (
+	// ProtocolBinary is the default protocol of the thrift servers.
+	ProtocolBinary Protocol = iota
+	// ProtocolCompact is the protocol of the thrift servers run with
+	// -compact.
+	ProtocolCompact
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolBinary:
+		return "binary"
+	case ProtocolCompact:
+		return "compact"
+	}
+	return "unknown"
+}
+
+// Transport is a thrift transport, i.e. a delimitation of the messages.
+type Transport int
+
+const (
+	// TransportFramed prefixes each message with its length.
+	TransportFramed Transport = iota
+	// TransportBuffered sends messages as they are.
+	TransportBuffered
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportFramed:
+		return "framed"
+	case TransportBuffered:
+		return "buffered"
+	}
+	return "unknown"
+}
+
+// defaultBufferSize is the default of Options.BufferSize.
+const defaultBufferSize = 8 * 1024
+
+// protocolFactory returns the factory of opt.Protocol.
+func protocolFactory(opt *Options) (thrift.TProtocolFactory, error) {
+	switch opt.Protocol {
+	case ProtocolBinary:
+		return thrift.NewTBinaryProtocolFactory(opt.StrictRead, !opt.NonStrictWrite), nil
+	case ProtocolCompact:
+		return thrift.NewTCompactProtocolFactory(), nil
+	}
+	return nil, &Error{Kind: ErrIllegalArgument, Msg: fmt.Sprintf("unknown protocol %d", opt.Protocol)}
+}
+
+// transportFactory returns the factory of opt.Transport. The socket is
+// buffered in both cases, so that a frame is written at once.
+func transportFactory(opt *Options) (thrift.TTransportFactory, error) {
+	buffered := thrift.NewTBufferedTransportFactory(opt.BufferSize)
+	switch opt.Transport {
+	case TransportFramed:
+		return thrift.NewTFramedTransportFactory(buffered), nil
+	case TransportBuffered:
+		return buffered, nil
+	}
+	return nil, &Error{Kind: ErrIllegalArgument, Msg: fmt.Sprintf("unknown transport %d", opt.Transport)}
+}
+
+// checkStack returns an error of kind ErrIllegalArgument if the protocol
+// or transport of opt is unknown, or if a transport other than the default
+// one is set in HTTP mode or with SASL, which delimit messages themselves.
+func checkStack(opt *Options) error {
+	if _, err := protocolFactory(opt); err != nil {
+		return err
+	}
+	if _, err := transportFactory(opt); err != nil {
+		return err
+	}
+	if opt.Transport != TransportFramed && (opt.HTTP || opt.SASL != nil) {
+		return &Error{Kind: ErrIllegalArgument, Msg: fmt.Sprintf("%s transport cannot be used in HTTP mode nor with SASL", opt.Transport)}
+	}
+	return nil
+}
+
+// initClient builds the client of the connection, which all its calls
+// share, on top of the HTTP or SASL transport if any, or else of opt.Transport.
+func (t *ThriftConn) initClient(opt *Options) error {
+	protocol, err := protocolFactory(opt)
+	if err != nil {
+		return err
+	}
+	transport, err := transportFactory(opt)
+	if err != nil {
+		return err
+	}
+
+	t.newClient = func() *hbase.THBaseServiceClient {
+		switch {
+		case t.http != nil:
+			return hbase.NewTHBaseServiceClientFactory(t.http, protocol)
+		case t.sasl != nil:
+			return hbase.NewTHBaseServiceClientFactory(t.sasl, protocol)
+		}
+		return hbase.NewTHBaseServiceClientFactory(transport.GetTransport(t.socket), protocol)
+	}
+	t.client = t.newClient()
+	return nil
+}
+
+// checkProtocol returns err, the error of a call on a connection of the
+// pool, as an ErrProtocolMismatch if it broke the connection while no call
+// to the server ever succeeded.
+func (tp *ThriftConnPool) checkProtocol(err error) error {
+	if !isBadConn(err) {
+		atomic.StoreUint32(&tp.answered, 1)
+		return err
+	}
+	if atomic.LoadUint32(&tp.answered) == 1 || !errors.Is(err, ErrConnBroken) {
+		return err
+	}
+	var te thrift.TTransportException
+	if errors.As(err, &te) {
+		if _, ok := te.Err().(httpStatusError); ok {
+			return err // 服务端已按 HTTP 应答，与协议无关
+		}
+	}
+	e, _ := err.(*Error)
+	if e == nil {
+		return err
+	}
+
+	stack := fmt.Sprintf("%s protocol, %s transport", tp.opt.Protocol, tp.opt.Transport)
+	if tp.opt.HTTP {
+		stack = fmt.Sprintf("%s protocol over HTTP", tp.opt.Protocol)
+	} else if tp.opt.SASL != nil {
+		stack = fmt.Sprintf("%s protocol over SASL", tp.opt.Protocol)
+	}
+	return &Error{
+		Kind: ErrProtocolMismatch,
+		Msg:  fmt.Sprintf("no call to %s succeeded yet, check that the server uses the %s: %s", tp.opt.Addr, stack, e.Msg),
+		Err:  err,
+	}
+}
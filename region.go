@@ -0,0 +1,206 @@
+// Package gohbase provides a pool of hbase clients
+package gohbase
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// regionReloadInterval is the minimum time between two loads of the region
+// locations of a table.
+const regionReloadInterval = time.Second
+
+// region is a cached region location, mapped to a thrift server address.
+type region struct {
+	start, end []byte
+	addr       string
+}
+
+func (r *region) contains(row []byte) bool {
+	return bytes.Compare(row, r.start) >= 0 && (len(r.end) == 0 || bytes.Compare(row, r.end) < 0)
+}
+
+type regionTable struct {
+	regions  []*region // 按 start 排序，互不重叠
+	loadedAt time.Time
+	stale    bool
+	loading  bool
+}
+
+// regionCache caches the region locations returned by
+// GetAllRegionLocations and GetRegionLocation, so that single-row calls go
+// to the thrift server on the host of the region server of their row.
+type regionCache struct {
+	mapper func(host string, port int32) string
+
+	mu     sync.Mutex
+	tables map[string]*regionTable
+}
+
+func newRegionCache(mapper func(host string, port int32) string) *regionCache {
+	return &regionCache{
+		mapper: mapper,
+		tables: make(map[string]*regionTable),
+	}
+}
+
+// newRegion returns the cached form of loc, or nil if loc does not serve
+// requests for its key range.
+func (rc *regionCache) newRegion(loc *hbase.THRegionLocation) *region {
+	info, server := loc.GetRegionInfo(), loc.GetServerName()
+	if info == nil || server == nil || info.GetOffline() || info.GetSplit() || info.GetReplicaId() != 0 {
+		return nil
+	}
+	addr := rc.mapper(server.GetHostName(), server.GetPort())
+	if addr == "" {
+		return nil
+	}
+	return &region{start: info.GetStartKey(), end: info.GetEndKey(), addr: addr}
+}
+
+func (rc *regionCache) table(table []byte) *regionTable {
+	t := rc.tables[string(table)]
+	if t == nil {
+		t = &regionTable{stale: true}
+		rc.tables[string(table)] = t
+	}
+	return t
+}
+
+// lookup returns the address of the thrift server for row, if known. load
+// reports whether the caller should load the locations of table; it is
+// then in charge of calling loaded.
+func (rc *regionCache) lookup(table, row []byte) (addr string, load bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := rc.table(table)
+	i := sort.Search(len(t.regions), func(i int) bool {
+		return bytes.Compare(t.regions[i].start, row) > 0
+	})
+	if i > 0 && t.regions[i-1].contains(row) {
+		return t.regions[i-1].addr, false
+	}
+
+	if t.stale && !t.loading && time.Since(t.loadedAt) >= regionReloadInterval {
+		t.loading = true
+		return "", true
+	}
+	return "", false
+}
+
+// loaded ends a load started by lookup, replacing the regions of table by
+// locs on success.
+func (rc *regionCache) loaded(table []byte, locs []*hbase.THRegionLocation, err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := rc.table(table)
+	t.loading = false
+	t.loadedAt = time.Now()
+	if err == nil {
+		rc.setLocked(t, locs)
+	}
+}
+
+// set replaces the regions of table by locs.
+func (rc *regionCache) set(table []byte, locs []*hbase.THRegionLocation) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := rc.table(table)
+	t.loadedAt = time.Now()
+	rc.setLocked(t, locs)
+}
+
+func (rc *regionCache) setLocked(t *regionTable, locs []*hbase.THRegionLocation) {
+	regions := make([]*region, 0, len(locs))
+	for _, loc := range locs {
+		if r := rc.newRegion(loc); r != nil {
+			regions = append(regions, r)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].start, regions[j].start) < 0
+	})
+	t.regions = regions
+	t.stale = false
+}
+
+// put caches loc, in place of the regions it overlaps.
+func (rc *regionCache) put(table []byte, loc *hbase.THRegionLocation) {
+	r := rc.newRegion(loc)
+	if r == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := rc.table(table)
+	regions := make([]*region, 0, len(t.regions)+1)
+	for _, o := range t.regions {
+		overlaps := (len(r.end) == 0 || bytes.Compare(o.start, r.end) < 0) &&
+			(len(o.end) == 0 || bytes.Compare(r.start, o.end) < 0)
+		if !overlaps {
+			regions = append(regions, o)
+		}
+	}
+	i := sort.Search(len(regions), func(i int) bool {
+		return bytes.Compare(regions[i].start, r.start) > 0
+	})
+	regions = append(regions, nil)
+	copy(regions[i+1:], regions[i:])
+	regions[i] = r
+	t.regions = regions
+}
+
+// invalidate forgets the region of row, e.g. after it moved, and marks the
+// locations of table to be loaded again.
+func (rc *regionCache) invalidate(table, row []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	t := rc.table(table)
+	for i, r := range t.regions {
+		if r.contains(row) {
+			t.regions = append(t.regions[:i:i], t.regions[i+1:]...)
+			break
+		}
+	}
+	t.stale = true
+}
+
+// route returns the pool of the thrift server on the host of the region of
+// row, or the pool picked by the balancer if that server is unknown or
+// unavailable.
+func (h *hBaseCMD) route(table, row []byte) *ThriftConnPool {
+	if h.regions == nil || row == nil {
+		return h.cluster.pick()
+	}
+
+	addr, load := h.regions.lookup(table, row)
+	if load {
+		go h.loadRegions(append([]byte(nil), table...))
+	}
+	if addr != "" {
+		if pool := h.cluster.poolFor(addr); pool != nil {
+			return pool
+		}
+	}
+	return h.cluster.pick()
+}
+
+func (h *hBaseCMD) loadRegions(table []byte) {
+	var locs []*hbase.THRegionLocation
+	err := h.process(context.Background(), "getAllRegionLocations", func(hc *hbase.THBaseServiceClient) (err error) {
+		locs, err = hc.GetAllRegionLocations(table)
+		return
+	})
+	h.regions.loaded(table, locs, err)
+}
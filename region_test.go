@@ -0,0 +1,231 @@
+package gohbase
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// newLocation returns the location of the region [start, end) on host.
+func newLocation(host, start, end string) *hbase.THRegionLocation {
+	port := int32(16020)
+	return &hbase.THRegionLocation{
+		ServerName: &hbase.TServerName{HostName: host, Port: &port},
+		RegionInfo: &hbase.THRegionInfo{TableName: []byte("t"), StartKey: []byte(start), EndKey: []byte(end)},
+	}
+}
+
+// hostAddr maps host to a made up thrift server address, none for host
+// "none".
+func hostAddr(host string, port int32) string {
+	if host == "none" {
+		return ""
+	}
+	return host + ":9090"
+}
+
+// expectRoutes checks the address cached for each row, "" if none.
+func expectRoutes(t *testing.T, rc *regionCache, routes map[string]string) {
+	t.Helper()
+	for row, want := range routes {
+		if addr, _ := rc.lookup([]byte("t"), []byte(row)); addr != want {
+			t.Errorf("row %q routed to %q, want %q", row, addr, want)
+		}
+	}
+}
+
+func TestRegionCacheSet(t *testing.T) {
+	rc := newRegionCache(hostAddr)
+	yes, replica := true, int32(1)
+	offline := newLocation("rs9", "a", "b")
+	offline.RegionInfo.Offline = &yes
+	split := newLocation("rs9", "b", "c")
+	split.RegionInfo.Split = &yes
+	secondary := newLocation("rs9", "c", "d")
+	secondary.RegionInfo.ReplicaId = &replica
+
+	rc.set([]byte("t"), []*hbase.THRegionLocation{
+		newLocation("rs3", "m", ""),
+		offline, split, secondary,
+		newLocation("rs1", "", "c"),
+		newLocation("rs2", "c", "m"),
+		newLocation("none", "x", "y"), // 没有对应的 thrift 服务
+	})
+	expectRoutes(t, rc, map[string]string{
+		"":    "rs1:9090",
+		"a":   "rs1:9090",
+		"bzz": "rs1:9090",
+		"c":   "rs2:9090",
+		"l":   "rs2:9090",
+		"m":   "rs3:9090",
+		"zzz": "rs3:9090",
+	})
+	if addr, _ := rc.lookup([]byte("other"), []byte("a")); addr != "" {
+		t.Errorf("row of an unknown table routed to %q", addr)
+	}
+}
+
+func TestRegionCachePut(t *testing.T) {
+	rc := newRegionCache(hostAddr)
+	rc.set([]byte("t"), []*hbase.THRegionLocation{
+		newLocation("rs1", "", "c"),
+		newLocation("rs2", "c", "m"),
+		newLocation("rs3", "m", ""),
+	})
+
+	// 合并后的 region 替换与之重叠的两个
+	rc.put([]byte("t"), newLocation("rs4", "b", "n"))
+	expectRoutes(t, rc, map[string]string{
+		"a": "",
+		"b": "rs4:9090",
+		"m": "rs4:9090",
+		"n": "",
+	})
+	if n := len(rc.tables["t"].regions); n != 1 {
+		t.Errorf("cache has %d regions, want 1", n)
+	}
+
+	rc.put([]byte("t"), newLocation("rs1", "", "b"))
+	rc.put([]byte("t"), newLocation("rs5", "n", ""))
+	expectRoutes(t, rc, map[string]string{
+		"a":   "rs1:9090",
+		"c":   "rs4:9090",
+		"zzz": "rs5:9090",
+	})
+
+	// 整张表一个 region
+	rc.put([]byte("t"), newLocation("rs6", "", ""))
+	if n := len(rc.tables["t"].regions); n != 1 {
+		t.Errorf("cache has %d regions after a table wide region, want 1", n)
+	}
+	expectRoutes(t, rc, map[string]string{"a": "rs6:9090", "zzz": "rs6:9090"})
+}
+
+func TestRegionCacheInvalidate(t *testing.T) {
+	rc := newRegionCache(hostAddr)
+	locs := []*hbase.THRegionLocation{
+		newLocation("rs1", "", "c"),
+		newLocation("rs2", "c", "m"),
+		newLocation("rs3", "m", ""),
+	}
+	rc.set([]byte("t"), locs)
+
+	rc.invalidate([]byte("t"), []byte("d"))
+	expectRoutes(t, rc, map[string]string{"a": "rs1:9090", "d": "", "x": "rs3:9090"})
+
+	// 刚加载过，不立即重新加载
+	if _, load := rc.lookup([]byte("t"), []byte("d")); load {
+		t.Fatal("lookup asked to load again within regionReloadInterval")
+	}
+	rc.mu.Lock()
+	rc.tables["t"].loadedAt = time.Now().Add(-regionReloadInterval)
+	rc.mu.Unlock()
+	if _, load := rc.lookup([]byte("t"), []byte("d")); !load {
+		t.Fatal("lookup did not ask to load an invalidated table")
+	}
+	if _, load := rc.lookup([]byte("t"), []byte("d")); load {
+		t.Fatal("lookup asked for a second load while one is running")
+	}
+
+	// 加载失败时保留已缓存的 region
+	rc.loaded([]byte("t"), nil, ErrConnBroken)
+	expectRoutes(t, rc, map[string]string{"a": "rs1:9090", "d": ""})
+
+	rc.mu.Lock()
+	rc.tables["t"].loadedAt = time.Now().Add(-regionReloadInterval)
+	rc.mu.Unlock()
+	if _, load := rc.lookup([]byte("t"), []byte("d")); !load {
+		t.Fatal("lookup did not ask to load again after a failed load")
+	}
+	rc.loaded([]byte("t"), locs, nil)
+	expectRoutes(t, rc, map[string]string{"d": "rs2:9090"})
+	if rc.tables["t"].stale {
+		t.Error("table is still stale after a load")
+	}
+}
+
+// regionHandler is a thrift server handler serving the region locations of
+// table t, and recording the rows it got.
+type regionHandler struct {
+	fakeHandler
+	locs []*hbase.THRegionLocation
+
+	mu    sync.Mutex
+	rows  []string
+	loads int
+}
+
+func (h *regionHandler) GetAllRegionLocations(table []byte) ([]*hbase.THRegionLocation, error) {
+	h.mu.Lock()
+	h.loads++
+	h.mu.Unlock()
+	return h.locs, nil
+}
+
+func (h *regionHandler) Get(table []byte, tget *hbase.TGet) (*hbase.TResult_, error) {
+	h.mu.Lock()
+	h.rows = append(h.rows, string(tget.Row))
+	h.mu.Unlock()
+	return h.fakeHandler.Get(table, tget)
+}
+
+func (h *regionHandler) reset() (rows []string, loads int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rows, loads = h.rows, h.loads
+	h.rows, h.loads = nil, 0
+	return rows, loads
+}
+
+func TestRegionRouting(t *testing.T) {
+	locs := []*hbase.THRegionLocation{
+		newLocation("rs1", "", "m"),
+		newLocation("rs2", "m", ""),
+	}
+	handlers := []*regionHandler{{locs: locs}, {locs: locs}}
+	addrs := map[string]string{} // region server -> thrift server
+	var all []string
+	for i, h := range handlers {
+		addr := newTestServer(t, h)
+		addrs["rs"+string(rune('1'+i))] = addr
+		all = append(all, addr)
+	}
+	hb := NewHBase(&Options{
+		Addrs:      all,
+		HostMapper: func(host string, port int32) string { return addrs[host] },
+	})
+	defer hb.Close()
+	rc := hb.(*hBaseCMD).regions
+
+	// 第一次调用在后台加载 region，本次调用由负载均衡选择服务
+	if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if addr, _ := rc.lookup([]byte("t"), []byte("a")); addr != "" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, loads0 := handlers[0].reset()
+	_, loads1 := handlers[1].reset()
+	if loads0+loads1 != 1 {
+		t.Fatalf("region locations loaded %d times, want 1", loads0+loads1)
+	}
+
+	for _, row := range []string{"a", "x", "b", "m", "l", "z"} {
+		if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte(row)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range []string{"a,b,l", "x,m,z"} {
+		rows, loads := handlers[i].reset()
+		if got := strings.Join(rows, ","); got != want || loads != 0 {
+			t.Errorf("rs%d got rows %s and %d loads, want %s and none", i+1, got, loads, want)
+		}
+	}
+}
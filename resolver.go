@@ -0,0 +1,236 @@
+// Package gohbase provides a pool of hbase clients
+package gohbase
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver supplies the addresses of the thrift servers. The client opens
+// a pool for each address, and adds or drains pools as the set changes.
+type Resolver interface {
+	// Resolve returns the current host:port addresses.
+	Resolve() ([]string, error)
+	// Watch calls update with the whole set of addresses each time it
+	// changes, until the resolver is closed. update must not block.
+	Watch(update func(addrs []string))
+	// Close stops watching.
+	Close() error
+}
+
+type staticResolver struct {
+	addrs []string
+}
+
+// NewStaticResolver returns a Resolver of a fixed set of addresses.
+func NewStaticResolver(addrs ...string) Resolver {
+	return &staticResolver{addrs: addrs}
+}
+
+func (r *staticResolver) Resolve() ([]string, error) {
+	return r.addrs, nil
+}
+
+func (r *staticResolver) Watch(func([]string)) {}
+
+func (r *staticResolver) Close() error {
+	return nil
+}
+
+// pollResolver runs lookup every interval and reports the changes.
+type pollResolver struct {
+	lookup   func() ([]string, error)
+	interval time.Duration
+	lookMu   sync.Mutex // lookup 不要求并发安全
+
+	mu       sync.Mutex
+	addrs    []string
+	closed   bool
+	stop     chan struct{}
+	watchers sync.WaitGroup
+}
+
+func newPollResolver(interval time.Duration, lookup func() ([]string, error)) *pollResolver {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return &pollResolver{
+		lookup:   lookup,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (r *pollResolver) Resolve() ([]string, error) {
+	r.lookMu.Lock()
+	addrs, err := r.lookup()
+	r.lookMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	addrs = normalizeAddrs(addrs)
+
+	r.mu.Lock()
+	r.addrs = addrs
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+func (r *pollResolver) Watch(update func([]string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.watchers.Add(1)
+	go func() {
+		defer r.watchers.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+
+			r.mu.Lock()
+			old := r.addrs
+			r.mu.Unlock()
+
+			// 查询失败时保留上一次的结果
+			addrs, err := r.Resolve()
+			if err != nil || len(addrs) == 0 || equalAddrs(old, addrs) {
+				continue
+			}
+			update(addrs)
+		}
+	}()
+}
+
+// Close stops watching. Once it returns, update is no longer called.
+func (r *pollResolver) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.stop)
+	r.mu.Unlock()
+
+	r.watchers.Wait()
+	return nil
+}
+
+// NewDNSResolver returns a Resolver of the IP addresses of host, as given
+// by its A and AAAA records, with port. Records are looked up again every
+// interval; default is 30 seconds.
+func NewDNSResolver(host string, port int, interval time.Duration) Resolver {
+	p := strconv.Itoa(port)
+	return newPollResolver(interval, func() ([]string, error) {
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, p))
+		}
+		return addrs, nil
+	})
+}
+
+// NewSRVResolver returns a Resolver of the targets of the SRV records of
+// _service._proto.name, e.g. NewSRVResolver("hbase-thrift", "tcp",
+// "example.com", 0). Records are looked up again every interval; default
+// is 30 seconds.
+func NewSRVResolver(service, proto, name string, interval time.Duration) Resolver {
+	return newPollResolver(interval, func() ([]string, error) {
+		_, srvs, err := net.LookupSRV(service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(srvs))
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return addrs, nil
+	})
+}
+
+// NewFileResolver returns a Resolver of the addresses listed in the file
+// at path, one host:port per line. Blank lines and lines starting with #
+// are ignored. The file is read again when its modification time changes,
+// checked every interval; default is 30 seconds.
+func NewFileResolver(path string, interval time.Duration) Resolver {
+	var (
+		modTime time.Time
+		addrs   []string
+	)
+	return newPollResolver(interval, func() ([]string, error) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if addrs != nil && fi.ModTime().Equal(modTime) {
+			return addrs, nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		var list []string
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			list = append(list, line)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		modTime, addrs = fi.ModTime(), list
+		return addrs, nil
+	})
+}
+
+// normalizeAddrs returns the sorted addresses without duplicates.
+func normalizeAddrs(addrs []string) []string {
+	out := append([]string(nil), addrs...)
+	sort.Strings(out)
+	n := 0
+	for i, addr := range out {
+		if i > 0 && addr == out[n-1] {
+			continue
+		}
+		out[n] = addr
+		n++
+	}
+	return out[:n]
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package gohbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAddrs writes the address file at path and moves its modification
+// time forward, so that the change is seen even within the resolution of
+// the file system clock.
+func writeAddrs(t *testing.T, path string, mtime time.Time, lines ...string) {
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gohbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers")
+	mtime := time.Now().Add(-time.Hour)
+	writeAddrs(t, path, mtime, "# thrift servers", "thrift2:9090", "", "  thrift1:9090  ", "thrift2:9090")
+
+	r := NewFileResolver(path, 10*time.Millisecond)
+	defer r.Close()
+	addrs, err := r.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(addrs, ","), "thrift1:9090,thrift2:9090"; got != want {
+		t.Fatalf("Resolve = %s, want %s", got, want)
+	}
+
+	updates := make(chan []string, 10)
+	r.Watch(func(addrs []string) { updates <- addrs })
+
+	// 内容不变时不通知
+	writeAddrs(t, path, mtime.Add(time.Minute), "thrift1:9090", "thrift2:9090")
+	select {
+	case addrs := <-updates:
+		t.Fatalf("Watch reported %v for an unchanged set", addrs)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeAddrs(t, path, mtime.Add(2*time.Minute), "thrift3:9090", "thrift1:9090")
+	select {
+	case addrs := <-updates:
+		if got, want := strings.Join(addrs, ","), "thrift1:9090,thrift3:9090"; got != want {
+			t.Fatalf("Watch reported %s, want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not report the new set")
+	}
+
+	// 文件读取失败或为空时保留上一次的结果
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(); err == nil {
+		t.Error("Resolve of a missing file succeeded")
+	}
+	writeAddrs(t, path, mtime.Add(3*time.Minute), "# none")
+	select {
+	case addrs := <-updates:
+		t.Fatalf("Watch reported %v for a missing or empty file", addrs)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeAddrs(t, path, mtime.Add(4*time.Minute), "thrift4:9090")
+	select {
+	case addrs := <-updates:
+		t.Fatalf("Watch reported %v after Close", addrs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,66 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// idempotent lists the commands, by thrift method name, whose sent requests
+// are retried. Other commands are only retried if the request was never
+// sent, or if the caller opts in with WithIdempotent.
+var idempotent = map[string]bool{
+	"exists":                true,
+	"get":                   true,
+	"getMultiple":           true,
+	"getScannerResults":     true,
+	"getRegionLocation":     true,
+	"getAllRegionLocations": true,
+}
+
+// retryBackoff returns the sleep before the given retry, an exponential
+// backoff between minBackoff and maxBackoff with full jitter.
+func retryBackoff(retry int, minBackoff, maxBackoff time.Duration) time.Duration {
+	if retry < 0 {
+		retry = 0
+	}
+	if minBackoff <= 0 {
+		return 0
+	}
+
+	backoff := minBackoff << uint(retry)
+	if backoff > maxBackoff || backoff < minBackoff {
+		backoff = maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// sleep waits for d unless ctx is done first or its deadline would pass
+// before the wait is over.
+func sleep(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := timers.Get().(*time.Timer)
+	timer.Reset(d)
+	select {
+	case <-ctx.Done():
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timers.Put(timer)
+		return ctx.Err()
+	case <-timer.C:
+		timers.Put(timer)
+		return nil
+	}
+}
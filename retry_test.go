@@ -0,0 +1,147 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	const min, max = 8 * time.Millisecond, 512 * time.Millisecond
+	for _, tc := range []struct {
+		retry int
+		limit time.Duration
+	}{
+		{-1, min},
+		{0, min},
+		{1, 2 * min},
+		{3, 8 * min},
+		{6, max},
+		{100, max}, // 移位溢出
+	} {
+		for i := 0; i < 100; i++ {
+			if d := retryBackoff(tc.retry, min, max); d < 0 || d >= tc.limit {
+				t.Fatalf("retryBackoff(%d) = %s, want in [0, %s)", tc.retry, d, tc.limit)
+			}
+		}
+	}
+	if d := retryBackoff(3, 0, max); d != 0 {
+		t.Errorf("retryBackoff without a minimum = %s, want 0", d)
+	}
+	if d := retryBackoff(3, min, 0); d != 0 {
+		t.Errorf("retryBackoff without a maximum = %s, want 0", d)
+	}
+}
+
+// brokenCall fails like a call whose connection broke after the request was
+// sent.
+func brokenCall(calls *int32) func(hc *hbase.THBaseServiceClient) error {
+	return func(hc *hbase.THBaseServiceClient) error {
+		atomic.AddInt32(calls, 1)
+		return thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION, "connection reset")
+	}
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	addr := newTestServer(t, &fakeHandler{})
+	for _, tc := range []struct {
+		op         string
+		idempotent bool
+		calls      int32
+	}{
+		{"get", false, 4},
+		{"exists", false, 4},
+		{"getMultiple", false, 4},
+		{"getScannerResults", false, 4},
+		{"put", false, 1},
+		{"increment", false, 1},
+		{"append", false, 1},
+		{"increment", true, 4},
+		{"append", true, 4},
+	} {
+		hb := NewHBase(&Options{Addr: addr, MinRetryBackoff: -1})
+		ctx := context.Background()
+		if tc.idempotent {
+			ctx = WithIdempotent(ctx)
+		}
+
+		var calls int32
+		err := hb.(*hBaseCMD).process(ctx, tc.op, brokenCall(&calls))
+		if !errors.Is(err, ErrConnBroken) {
+			t.Errorf("%s = %v, want %v", tc.op, err, ErrConnBroken)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s (idempotent %v) sent %d times, want %d", tc.op, tc.idempotent, calls, tc.calls)
+		}
+		_ = hb.Close()
+	}
+}
+
+// incrementHandler answers Increment with the row asked for.
+type incrementHandler struct {
+	fakeHandler
+}
+
+func (h *incrementHandler) Increment(table []byte, tincrement *hbase.TIncrement) (*hbase.TResult_, error) {
+	return &hbase.TResult_{Row: tincrement.Row}, nil
+}
+
+func TestRetryNotSent(t *testing.T) {
+	addr := newTestServer(t, &incrementHandler{})
+	var dials int32
+	hb := NewHBase(&Options{
+		Addr: addr,
+		// 前两次拨号失败，请求未发出
+		Dialer: func(ctx context.Context, network, a string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) <= 2 {
+				return nil, errors.New("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		MinRetryBackoff: -1,
+	})
+	defer hb.Close()
+
+	r, err := hb.Increment([]byte("t"), &hbase.TIncrement{Row: []byte("row")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Row) != "row" {
+		t.Errorf("Increment returned row %q, want %q", r.Row, "row")
+	}
+	if dials != 3 {
+		t.Errorf("dialed %d times, want 3", dials)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	hb := NewHBase(&Options{
+		Addr:            newTestServer(t, &fakeHandler{}),
+		MaxRetries:      100,
+		MinRetryBackoff: time.Hour,
+		MaxRetryBackoff: time.Hour,
+	})
+	defer hb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var calls int32
+	err := hb.(*hBaseCMD).process(ctx, "get", brokenCall(&calls))
+	if !errors.Is(err, ErrConnBroken) {
+		t.Errorf("get = %v, want the error of the last attempt", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("get returned after %s, past the deadline", d)
+	}
+	if calls > 10 {
+		t.Errorf("get sent %d times before the deadline", calls)
+	}
+}
@@ -0,0 +1,390 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// ErrAuthFailed is the kind of the errors returned when the SASL
+// negotiation of a new connection fails, or in HTTP mode when the server
+// answers 401 Unauthorized or 403 Forbidden.
+var ErrAuthFailed = errors.New("HBase: authentication failed")
+
+// QoP is a SASL quality of protection, as set on the servers by
+// hbase.thrift.security.qop.
+type QoP byte
+
+const (
+	// QoPAuth is authentication only ("auth").
+	QoPAuth QoP = 1
+	// QoPAuthInt is authentication with integrity protection ("auth-int").
+	QoPAuthInt QoP = 2
+	// QoPAuthConf is authentication with integrity and confidentiality
+	// protection ("auth-conf").
+	QoPAuthConf QoP = 4
+)
+
+func (q QoP) String() string {
+	switch q {
+	case QoPAuth:
+		return "auth"
+	case QoPAuthInt:
+		return "auth-int"
+	case QoPAuthConf:
+		return "auth-conf"
+	}
+	return "unknown"
+}
+
+// SASLClient is the client side of a SASL authentication exchange, for a
+// single connection.
+type SASLClient interface {
+	// Mechanism returns the name of the mechanism, e.g. "GSSAPI".
+	Mechanism() string
+	// Start returns the initial response.
+	Start() ([]byte, error)
+	// Step returns the response to a challenge of the server.
+	Step(challenge []byte) ([]byte, error)
+	// Complete reports whether the exchange is over on the client side.
+	Complete() bool
+	// Wrap and Unwrap protect the messages sent and received once the
+	// exchange is over, with the negotiated quality of protection. For
+	// QoPAuth, they return their input.
+	Wrap(p []byte) ([]byte, error)
+	Unwrap(p []byte) ([]byte, error)
+}
+
+type plainClient struct {
+	authzid, user, password string
+	complete                bool
+}
+
+// NewPlainSASL returns a SASL factory, for Options.SASL, of the PLAIN
+// mechanism. authzid is the identity to act as, empty for user itself.
+// PLAIN sends the password in clear, so it should be used over TLS only.
+func NewPlainSASL(authzid, user, password string) func(host string) (SASLClient, error) {
+	return func(string) (SASLClient, error) {
+		return &plainClient{authzid: authzid, user: user, password: password}, nil
+	}
+}
+
+func (c *plainClient) Mechanism() string {
+	return "PLAIN"
+}
+
+func (c *plainClient) Start() ([]byte, error) {
+	c.complete = true
+	return []byte(c.authzid + "\x00" + c.user + "\x00" + c.password), nil
+}
+
+func (c *plainClient) Step([]byte) ([]byte, error) {
+	return nil, errors.New("unexpected challenge")
+}
+
+func (c *plainClient) Complete() bool {
+	return c.complete
+}
+
+func (c *plainClient) Wrap(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+func (c *plainClient) Unwrap(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+// GSSContext is a Kerberos GSS-API security context initiated by the
+// client. It is used by the GSSAPI mechanism of NewGSSAPISASL.
+//
+// Kerberos.NewGSSContext returns the contexts of a login from a keytab or
+// a credential cache; another Kerberos library can be used by implementing
+// GSSContext with it.
+type GSSContext interface {
+	// InitSecContext processes the token of the server, nil at first,
+	// and returns the token to send to it. done is true once the context
+	// is established.
+	InitSecContext(token []byte) (out []byte, done bool, err error)
+	// Wrap protects a message, encrypting it if confidential is set.
+	Wrap(p []byte, confidential bool) ([]byte, error)
+	// Unwrap checks, and decrypts if needed, a message of the server.
+	Unwrap(p []byte) ([]byte, error)
+}
+
+type gssapiClient struct {
+	ctx     GSSContext
+	qops    []QoP
+	authzid string
+
+	established bool
+	complete    bool
+	qop         QoP
+}
+
+// NewGSSAPISASL returns a SASL factory, for Options.SASL, of the GSSAPI
+// mechanism, i.e. Kerberos. newContext returns a security context for the
+// service principal service/host, e.g. "hbase" and the host of the thrift
+// server, as Kerberos.NewGSSContext does. qops are the qualities of protection accepted, by order of
+// preference; default is QoPAuthConf, QoPAuthInt, then QoPAuth. authzid is
+// the identity to act as, empty for the principal itself.
+func NewGSSAPISASL(service, authzid string, newContext func(service, host string) (GSSContext, error), qops ...QoP) func(host string) (SASLClient, error) {
+	if len(qops) == 0 {
+		qops = []QoP{QoPAuthConf, QoPAuthInt, QoPAuth}
+	}
+	return func(host string) (SASLClient, error) {
+		ctx, err := newContext(service, host)
+		if err != nil {
+			return nil, err
+		}
+		return &gssapiClient{ctx: ctx, qops: qops, authzid: authzid}, nil
+	}
+}
+
+func (c *gssapiClient) Mechanism() string {
+	return "GSSAPI"
+}
+
+func (c *gssapiClient) Start() ([]byte, error) {
+	out, done, err := c.ctx.InitSecContext(nil)
+	c.established = done
+	return out, err
+}
+
+func (c *gssapiClient) Step(challenge []byte) ([]byte, error) {
+	if !c.established {
+		out, done, err := c.ctx.InitSecContext(challenge)
+		c.established = done
+		return out, err
+	}
+	if c.complete {
+		return nil, errors.New("unexpected challenge")
+	}
+
+	// RFC 4752: 服务端给出支持的保护级别和最大报文长度，客户端选择其一
+	offer, err := c.ctx.Unwrap(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if len(offer) != 4 {
+		return nil, fmt.Errorf("invalid security layer offer of %d bytes", len(offer))
+	}
+	for _, qop := range c.qops {
+		if offer[0]&byte(qop) == 0 {
+			continue
+		}
+		resp := make([]byte, 4, 4+len(c.authzid))
+		resp[0] = byte(qop)
+		if qop != QoPAuth {
+			copy(resp[1:], offer[1:])
+		}
+		resp = append(resp, c.authzid...)
+
+		wrapped, err := c.ctx.Wrap(resp, false)
+		if err != nil {
+			return nil, err
+		}
+		c.qop = qop
+		c.complete = true
+		return wrapped, nil
+	}
+	return nil, fmt.Errorf("no common quality of protection, server offers %#x", offer[0])
+}
+
+func (c *gssapiClient) Complete() bool {
+	return c.complete
+}
+
+func (c *gssapiClient) Wrap(p []byte) ([]byte, error) {
+	if c.qop == QoPAuth {
+		return p, nil
+	}
+	return c.ctx.Wrap(p, c.qop == QoPAuthConf)
+}
+
+func (c *gssapiClient) Unwrap(p []byte) ([]byte, error) {
+	if c.qop == QoPAuth {
+		return p, nil
+	}
+	return c.ctx.Unwrap(p)
+}
+
+// SASL negotiation status, as in TSaslTransport.
+const (
+	saslStart    = 1
+	saslOK       = 2
+	saslBad      = 3
+	saslError    = 4
+	saslComplete = 5
+)
+
+// saslTransport is the client side of the thrift SASL transport. After the
+// negotiation, every message is sent as a frame of its length followed by
+// its wrapped bytes. Frames are what HBase expects in place of the framed
+// transport, which it does not allow together with SASL.
+type saslTransport struct {
+	trans  thrift.TTransport
+	client SASLClient
+
+	wbuf bytes.Buffer
+	rbuf bytes.Reader
+}
+
+func newSASLTransport(trans thrift.TTransport, client SASLClient) *saslTransport {
+	return &saslTransport{trans: trans, client: client}
+}
+
+// negotiate runs the authentication exchange.
+func (t *saslTransport) negotiate() error {
+	initial, err := t.client.Start()
+	if err != nil {
+		return t.fail(err)
+	}
+	if err := t.send(saslStart, []byte(t.client.Mechanism())); err != nil {
+		return err
+	}
+	status := byte(saslOK)
+	if t.client.Complete() {
+		status = saslComplete
+	}
+	if err := t.send(status, initial); err != nil {
+		return err
+	}
+
+	for {
+		status, payload, err := t.receive()
+		if err != nil {
+			return err
+		}
+		switch status {
+		case saslOK, saslComplete:
+		case saslBad, saslError:
+			return &Error{Kind: ErrAuthFailed, Msg: string(payload)}
+		default:
+			return &Error{Kind: ErrAuthFailed, Msg: fmt.Sprintf("invalid SASL status %d", status)}
+		}
+
+		if status == saslComplete && t.client.Complete() {
+			return nil
+		}
+		resp, err := t.client.Step(payload)
+		if err != nil {
+			return t.fail(err)
+		}
+		if status == saslComplete {
+			if !t.client.Complete() {
+				return &Error{Kind: ErrAuthFailed, Msg: "server completed the negotiation early"}
+			}
+			return nil
+		}
+
+		status = saslOK
+		if t.client.Complete() {
+			status = saslComplete
+		}
+		if err := t.send(status, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// fail reports err to the server and returns it.
+func (t *saslTransport) fail(err error) error {
+	_ = t.send(saslError, []byte(err.Error()))
+	return &Error{Kind: ErrAuthFailed, Msg: err.Error(), Err: err}
+}
+
+func (t *saslTransport) send(status byte, payload []byte) error {
+	var header [5]byte
+	header[0] = status
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := t.trans.Write(header[:]); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := t.trans.Write(payload); err != nil {
+			return err
+		}
+	}
+	return t.trans.Flush()
+}
+
+func (t *saslTransport) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(t.trans, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload, err := t.readPayload(binary.BigEndian.Uint32(header[1:]))
+	return header[0], payload, err
+}
+
+func (t *saslTransport) readPayload(n uint32) ([]byte, error) {
+	if n > thrift.DEFAULT_MAX_LENGTH {
+		return nil, thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION, fmt.Sprintf("SASL frame of %d bytes is too large", n))
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(t.trans, payload)
+	return payload, err
+}
+
+func (t *saslTransport) Open() error {
+	return nil
+}
+
+func (t *saslTransport) IsOpen() bool {
+	return t.trans.IsOpen()
+}
+
+func (t *saslTransport) Close() error {
+	return t.trans.Close()
+}
+
+func (t *saslTransport) Read(p []byte) (int, error) {
+	if t.rbuf.Len() == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(t.trans, header[:]); err != nil {
+			return 0, err
+		}
+		frame, err := t.readPayload(binary.BigEndian.Uint32(header[:]))
+		if err != nil {
+			return 0, err
+		}
+		if frame, err = t.client.Unwrap(frame); err != nil {
+			return 0, thrift.NewTTransportExceptionFromError(err)
+		}
+		t.rbuf.Reset(frame)
+	}
+	return t.rbuf.Read(p)
+}
+
+func (t *saslTransport) Write(p []byte) (int, error) {
+	return t.wbuf.Write(p)
+}
+
+// Flush sends the buffered bytes as one frame.
+func (t *saslTransport) Flush() error {
+	frame, err := t.client.Wrap(t.wbuf.Bytes())
+	t.wbuf.Reset()
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+	if _, err := t.trans.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := t.trans.Write(frame); err != nil {
+		return err
+	}
+	return t.trans.Flush()
+}
+
+func (t *saslTransport) RemainingBytes() uint64 {
+	return uint64(t.rbuf.Len())
+}
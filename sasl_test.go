@@ -0,0 +1,253 @@
+package gohbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// fakeSASLServer is the server side of the thrift SASL transport, over one
+// end of a net.Pipe.
+type fakeSASLServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (s *fakeSASLServer) receive() (byte, []byte) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		s.t.Errorf("server read: %v", err)
+		return 0, nil
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		s.t.Errorf("server read: %v", err)
+	}
+	return header[0], payload
+}
+
+func (s *fakeSASLServer) send(status byte, payload []byte) {
+	var header [5]byte
+	header[0] = status
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, _ = s.conn.Write(append(header[:], payload...))
+}
+
+func (s *fakeSASLServer) readFrame() []byte {
+	var header [4]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		s.t.Errorf("server read: %v", err)
+		return nil
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, _ = io.ReadFull(s.conn, frame)
+	return frame
+}
+
+func (s *fakeSASLServer) writeFrame(frame []byte) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+	_, _ = s.conn.Write(append(header[:], frame...))
+}
+
+// xorGSSContext is a GSSContext established after two tokens, which
+// "encrypts" by xoring the bytes.
+type xorGSSContext struct {
+	steps int
+	wraps []bool
+}
+
+func xorBytes(p []byte) []byte {
+	out := make([]byte, len(p))
+	for i := range p {
+		out[i] = p[i] ^ 0x5a
+	}
+	return out
+}
+
+func (c *xorGSSContext) InitSecContext(token []byte) ([]byte, bool, error) {
+	c.steps++
+	if c.steps == 1 {
+		return []byte("token1"), false, nil
+	}
+	if string(token) != "challenge1" {
+		return nil, false, errors.New("unexpected token " + string(token))
+	}
+	return []byte("token2"), true, nil
+}
+
+func (c *xorGSSContext) Wrap(p []byte, confidential bool) ([]byte, error) {
+	c.wraps = append(c.wraps, confidential)
+	return xorBytes(p), nil
+}
+
+func (c *xorGSSContext) Unwrap(p []byte) ([]byte, error) {
+	return xorBytes(p), nil
+}
+
+func newTestSASL(t *testing.T, client SASLClient) (*saslTransport, *fakeSASLServer) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	return newSASLTransport(thrift.NewTSocketFromConnTimeout(c, 0), client), &fakeSASLServer{t: t, conn: s}
+}
+
+func TestSASLPlain(t *testing.T) {
+	client, _ := NewPlainSASL("", "alice", "secret")("thrift1")
+	trans, srv := newTestSASL(t, client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if status, mech := srv.receive(); status != saslStart || string(mech) != "PLAIN" {
+			t.Errorf("start = %d %q", status, mech)
+		}
+		if status, resp := srv.receive(); status != saslComplete || string(resp) != "\x00alice\x00secret" {
+			t.Errorf("response = %d %q", status, resp)
+		}
+		srv.send(saslComplete, nil)
+
+		if frame := srv.readFrame(); string(frame) != "ping" {
+			t.Errorf("frame = %q", frame)
+		}
+		srv.writeFrame([]byte("pong"))
+	}()
+
+	if err := trans.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = trans.Write([]byte("ping"))
+	if err := trans.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(trans, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	<-done
+}
+
+func TestSASLPlainRejected(t *testing.T) {
+	client, _ := NewPlainSASL("", "alice", "wrong")("thrift1")
+	trans, srv := newTestSASL(t, client)
+
+	go func() {
+		srv.receive()
+		srv.receive()
+		srv.send(saslBad, []byte("bad password"))
+	}()
+
+	err := trans.negotiate()
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("negotiate() = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestSASLGSSAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		offer byte
+		qops  []QoP
+		want  QoP
+	}{
+		{"auth-conf preferred", 0x07, nil, QoPAuthConf},
+		{"auth only offered", 0x01, nil, QoPAuth},
+		{"auth-int required", 0x07, []QoP{QoPAuthInt}, QoPAuthInt},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gss := &xorGSSContext{}
+			newClient := NewGSSAPISASL("hbase", "bob", func(service, host string) (GSSContext, error) {
+				if service != "hbase" || host != "thrift1" {
+					t.Errorf("context for %s/%s", service, host)
+				}
+				return gss, nil
+			}, tc.qops...)
+			client, err := newClient("thrift1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			trans, srv := newTestSASL(t, client)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if status, mech := srv.receive(); status != saslStart || string(mech) != "GSSAPI" {
+					t.Errorf("start = %d %q", status, mech)
+				}
+				if _, tok := srv.receive(); string(tok) != "token1" {
+					t.Errorf("token = %q", tok)
+				}
+				srv.send(saslOK, []byte("challenge1"))
+				if _, tok := srv.receive(); string(tok) != "token2" {
+					t.Errorf("token = %q", tok)
+				}
+				// 服务端提供的保护级别，最大报文长度 1 MiB
+				srv.send(saslOK, xorBytes([]byte{tc.offer, 0x10, 0, 0}))
+				status, resp := srv.receive()
+				resp = xorBytes(resp)
+				if status != saslComplete || len(resp) < 4 || QoP(resp[0]) != tc.want || string(resp[4:]) != "bob" {
+					t.Errorf("layer response = %d %v", status, resp)
+				}
+				srv.send(saslComplete, nil)
+
+				frame := srv.readFrame()
+				if tc.want != QoPAuth {
+					frame = xorBytes(frame)
+				}
+				if string(frame) != "ping" {
+					t.Errorf("frame = %q", frame)
+				}
+				reply := []byte("pong")
+				if tc.want != QoPAuth {
+					reply = xorBytes(reply)
+				}
+				srv.writeFrame(reply)
+			}()
+
+			if err := trans.negotiate(); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = trans.Write([]byte("ping"))
+			if err := trans.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(trans, buf); err != nil || !bytes.Equal(buf, []byte("pong")) {
+				t.Fatalf("read %q, %v", buf, err)
+			}
+			<-done
+
+			if tc.want == QoPAuthConf && !gss.wraps[len(gss.wraps)-1] {
+				t.Error("messages not wrapped for confidentiality")
+			}
+		})
+	}
+}
+
+func TestSASLGSSAPINoCommonQoP(t *testing.T) {
+	newClient := NewGSSAPISASL("hbase", "", func(service, host string) (GSSContext, error) {
+		return &xorGSSContext{}, nil
+	}, QoPAuthConf)
+	client, _ := newClient("thrift1")
+	trans, srv := newTestSASL(t, client)
+
+	go func() {
+		srv.receive()
+		srv.receive()
+		srv.send(saslOK, []byte("challenge1"))
+		srv.receive()
+		srv.send(saslOK, xorBytes([]byte{byte(QoPAuth), 0, 0, 0}))
+		srv.receive() // 客户端报告的错误
+	}()
+
+	if err := trans.negotiate(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("negotiate() = %v, want ErrAuthFailed", err)
+	}
+}
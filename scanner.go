@@ -0,0 +1,97 @@
+// Package gohbase provides a pool of hbase clients
+package gohbase
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// Scanner is a scanner opened by HBase.Scan. A scanner id is only known to
+// the thrift server that opened it, so every call of a Scanner goes through
+// the connection it was opened on. The connection is given back to the pool
+// between calls and may serve other requests meanwhile; it is exempt from
+// idle and age based reaping until the Scanner is closed.
+//
+// A Scanner must not be used by several goroutines at once. Once its
+// connection is closed, calls fail with an error of kind ErrScannerExpired.
+type Scanner struct {
+	h    *hBaseCMD
+	pool *ThriftConnPool
+	cn   *ThriftConn
+	id   int32
+	user string // doAs 用户，后续调用沿用
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// ID returns the id of the scanner on its thrift server.
+func (s *Scanner) ID() int32 {
+	return s.id
+}
+
+// Next grabs up to numRows rows from the scanner. No rows are returned once
+// the scanner is exhausted.
+func (s *Scanner) Next(numRows int32) ([]*hbase.TResult_, error) {
+	return s.NextContext(context.Background(), numRows)
+}
+
+// NextContext is Next with a context.
+func (s *Scanner) NextContext(ctx context.Context, numRows int32) (r []*hbase.TResult_, err error) {
+	err = s.do(ctx, func(hc *hbase.THBaseServiceClient) (err error) {
+		r, err = hc.GetScannerRows(s.id, numRows)
+		return
+	})
+	return
+}
+
+// Close closes the scanner to free its server side resources, and unpins
+// its connection. It is a no-op on a closed Scanner.
+func (s *Scanner) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext is Close with a context.
+func (s *Scanner) CloseContext(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer atomic.AddInt32(&s.cn.pins, -1)
+
+	return s.doLocked(ctx, func(hc *hbase.THBaseServiceClient) error {
+		return hc.CloseScanner(s.id)
+	})
+}
+
+func (s *Scanner) do(ctx context.Context, fn func(hc *hbase.THBaseServiceClient) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return &Error{Kind: ErrScannerExpired, Msg: "scanner is closed"}
+	}
+	return s.doLocked(ctx, fn)
+}
+
+func (s *Scanner) doLocked(ctx context.Context, fn func(hc *hbase.THBaseServiceClient) error) error {
+	if err := s.pool.GetConn(ctx, s.cn); err != nil {
+		if err == ErrClosed || err == errConnGone {
+			// 连接池被关闭或排空时，连接随之关闭
+			return errConnGone
+		}
+		err = wrapError(err)
+		s.h.cluster.observe(s.pool, err, 0)
+		return err
+	}
+	if s.user != "" {
+		ctx = WithUser(ctx, s.user)
+	}
+	return s.h.run(ctx, s.pool, s.cn, fn)
+}
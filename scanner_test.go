@@ -0,0 +1,246 @@
+package gohbase
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tianxingpan/gohbase/hbase"
+)
+
+// scanHandler is a thrift server handler of scanners. Scanner ids are only
+// known to the handler that opened them; rows are tagged with its name.
+type scanHandler struct {
+	fakeHandler
+	name string
+
+	mu       sync.Mutex
+	nextID   int32
+	scanners map[int32]int // 已返回的行数
+}
+
+func newScanHandler(name string) *scanHandler {
+	return &scanHandler{name: name, nextID: 1, scanners: make(map[int32]int)}
+}
+
+func (h *scanHandler) OpenScanner(table []byte, tscan *hbase.TScan) (int32, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.scanners[id] = 0
+	return id, nil
+}
+
+func (h *scanHandler) GetScannerRows(scannerID int32, numRows int32) ([]*hbase.TResult_, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, ok := h.scanners[scannerID]
+	if !ok {
+		msg := "Invalid scanner Id"
+		return nil, &hbase.TIllegalArgument{Message: &msg}
+	}
+	var rows []*hbase.TResult_
+	for i := int32(0); i < numRows; i++ {
+		rows = append(rows, &hbase.TResult_{Row: []byte(h.name + "/" + strconv.Itoa(n))})
+		n++
+	}
+	h.scanners[scannerID] = n
+	return rows, nil
+}
+
+func (h *scanHandler) CloseScanner(scannerID int32) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.scanners[scannerID]; !ok {
+		msg := "Invalid scanner Id"
+		return &hbase.TIllegalArgument{Message: &msg}
+	}
+	delete(h.scanners, scannerID)
+	return nil
+}
+
+// open returns the number of scanners open on the handler.
+func (h *scanHandler) open() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.scanners)
+}
+
+func TestScannerPinnedConn(t *testing.T) {
+	handlers := map[string]*scanHandler{}
+	var addrs []string
+	for _, name := range []string{"a", "b"} {
+		h := newScanHandler(name)
+		addr := newTestServer(t, h)
+		handlers[addr] = h
+		addrs = append(addrs, addr)
+	}
+	hb := NewHBase(&Options{Addrs: addrs, Balancer: NewRoundRobinBalancer(), PoolSize: 1})
+	defer hb.Close()
+
+	s, err := hb.Scan([]byte("t"), &hbase.TScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn := s.cn
+	h := handlers[cn.Endpoint]
+
+	for i := 0; i < 3; i++ {
+		// 其他请求轮流发往两个端点，共用扫描器空闲的连接
+		if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")}); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := s.Next(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := h.name + "/" + strconv.Itoa(2*i)
+		if len(rows) != 2 || string(rows[0].Row) != want {
+			t.Fatalf("Next returned %d rows, want 2 from %q", len(rows), want)
+		}
+		if s.cn != cn {
+			t.Fatal("scanner changed connection")
+		}
+	}
+	for addr, s := range hb.EndpointStats() {
+		if s.TotalConns != 1 {
+			t.Errorf("%s has %d connections, want 1", addr, s.TotalConns)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.open(); n != 0 {
+		t.Errorf("%d scanners left open on the server", n)
+	}
+	if cn.pinned() {
+		t.Error("connection is still pinned after Close")
+	}
+	if _, err := s.Next(1); !errors.Is(err, ErrScannerExpired) {
+		t.Errorf("Next after Close = %v, want %v", err, ErrScannerExpired)
+	}
+}
+
+func TestScannerReaperExemption(t *testing.T) {
+	hb := NewHBase(&Options{
+		Addr:               newTestServer(t, newScanHandler("a")),
+		PoolSize:           1,
+		IdleTimeout:        20 * time.Millisecond,
+		MaxConnAge:         20 * time.Millisecond,
+		IdleCheckFrequency: 5 * time.Millisecond,
+	})
+	defer hb.Close()
+
+	s, err := hb.Scan([]byte("t"), &hbase.TScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.cn.IsClose() {
+		t.Fatal("reaper closed the connection of an open scanner")
+	}
+	// 过期的连接仍可被其他请求借用
+	if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Next(1); err != nil {
+		t.Fatal(err)
+	}
+	if stats := hb.PoolStats(); stats.ExpiredConns != 0 || stats.StaleConns != 0 {
+		t.Errorf("reaped %d expired and %d stale connections, want none", stats.ExpiredConns, stats.StaleConns)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !s.cn.IsClose() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !s.cn.IsClose() {
+		t.Error("reaper kept the connection of a closed scanner")
+	}
+}
+
+func TestScannerConnGone(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		gone func(s *Scanner, raw net.Conn)
+	}{
+		{"reaped", func(s *Scanner, raw net.Conn) {
+			_ = s.pool.CloseConn(s.cn)
+		}},
+		{"broken", func(s *Scanner, raw net.Conn) {
+			// 连接在扫描途中断开，下一次调用失败并移除连接
+			_ = raw.Close()
+			if _, err := s.Next(1); !errors.Is(err, ErrConnBroken) {
+				t.Errorf("Next on a broken connection = %v, want %v", err, ErrConnBroken)
+			}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var raws []net.Conn
+			hb := NewHBase(&Options{
+				Addr: newTestServer(t, newScanHandler("a")),
+				Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					conn, err := d.DialContext(ctx, network, addr)
+					if err == nil {
+						mu.Lock()
+						raws = append(raws, conn)
+						mu.Unlock()
+					}
+					return conn, err
+				},
+				PoolSize: 1,
+			})
+			defer hb.Close()
+
+			s, err := hb.Scan([]byte("t"), &hbase.TScan{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Next(1); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			raw := raws[0]
+			mu.Unlock()
+			tc.gone(s, raw)
+
+			if _, err := s.Next(1); !errors.Is(err, ErrScannerExpired) || err != errConnGone {
+				t.Errorf("Next after the connection left the pool = %v, want %v", err, errConnGone)
+			}
+			if err := s.Close(); !errors.Is(err, ErrScannerExpired) {
+				t.Errorf("Close after the connection left the pool = %v, want %v", err, ErrScannerExpired)
+			}
+			// 连接池可以继续使用
+			if _, err := hb.Get([]byte("t"), &hbase.TGet{Row: []byte("row")}); err != nil {
+				t.Errorf("Get after the scanner connection left = %v", err)
+			}
+		})
+	}
+}
+
+func TestScannerPoolClosed(t *testing.T) {
+	hb := NewHBase(&Options{Addr: newTestServer(t, newScanHandler("a"))})
+	defer hb.Close()
+
+	s, err := hb.Scan([]byte("t"), &hbase.TScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 端点被移除后，连接池排空并关闭
+	_ = s.pool.Close()
+	if _, err := s.Next(1); err != errConnGone {
+		t.Errorf("Next once the pool was closed = %v, want %v", err, errConnGone)
+	}
+}
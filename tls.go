@@ -0,0 +1,128 @@
+// Package gohbase provides a pool of hbase clients
+
+package gohbase
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsHandshake runs the client side of a TLS handshake on conn, before
+// deadline unless it is zero. The server name defaults to the host of addr.
+func tlsHandshake(conn net.Conn, addr string, config *tls.Config, deadline time.Time) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	_ = conn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// tlsCheck reports whether an idle TLS connection is still usable. The
+// records already received are read through the TLS layer, which consumes
+// those it handles itself, such as the session tickets sent by TLS 1.3
+// servers after the handshake; any application data is a stale response.
+// pending tells that the network connection holds unread data, which is
+// waited for briefly.
+func tlsCheck(conn net.Conn, pending bool) error {
+	deadline := aLongTimeAgo
+	if pending {
+		deadline = time.Now().Add(time.Millisecond)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return errUnexpectedRead
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// CertReloader loads a client certificate, for mutual TLS, from a pair of
+// PEM files, and loads it again when one of them changes, so that renewed
+// certificates are used by new connections without rebuilding the client:
+//
+//	r, err := gohbase.NewCertReloader("client.crt", "client.key")
+//	...
+//	opt.TLSConfig = &tls.Config{GetClientCertificate: r.GetClientCertificate}
+//
+// The CAs the servers are verified with, tls.Config.RootCAs, are not
+// reloaded: the client must be rebuilt for new CAs to be trusted.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader returns a CertReloader of the certificate in certFile
+// and its key in keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Certificate returns the certificate, loaded again if the files were
+// modified since the last call. If loading fails, e.g. while the files are
+// being replaced, the previous certificate is kept.
+func (r *CertReloader) Certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return r.fallback(err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return r.fallback(err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return r.fallback(err)
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return r.cert, nil
+}
+
+func (r *CertReloader) fallback(err error) (*tls.Certificate, error) {
+	if r.cert != nil {
+		return r.cert, nil
+	}
+	return nil, err
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate()
+}
@@ -0,0 +1,104 @@
+package gohbase
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate for 127.0.0.1 and the pool
+// of CAs trusting it.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gohbase test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+func TestValidateTLSConn(t *testing.T) {
+	cert, roots := newTestCert(t)
+	for _, tc := range []struct {
+		name  string
+		stale bool
+	}{
+		{"session tickets", false},
+		{"stale data", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS13,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				if tc.stale {
+					_, _ = conn.Write([]byte("x"))
+				}
+				var b [1]byte
+				_, _ = conn.Read(b[:])
+			}()
+
+			opt := &Options{Addr: ln.Addr().String(), TLSConfig: &tls.Config{RootCAs: roots}}
+			opt.init()
+			pool := NewThriftConnPool(opt)
+			defer pool.Close()
+			cn, err := newThriftConn(context.Background(), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cn.Close()
+
+			// 等待服务端在握手后发送的数据到达
+			time.Sleep(50 * time.Millisecond)
+			err = pool.validateConn(context.Background(), cn)
+			if tc.stale && err != errUnexpectedRead {
+				t.Errorf("validateConn = %v, want %v", err, errUnexpectedRead)
+			}
+			if !tc.stale && err != nil {
+				t.Errorf("validateConn = %v, want nil", err)
+			}
+		})
+	}
+}